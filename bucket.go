@@ -38,11 +38,16 @@ type PeerInfo struct {
 // it WILL be the caller's responsibility to synchronize all access to a bucket.
 type bucket struct {
 	list *list.List
+
+	// replacements holds the candidates that were turned away because the bucket was full,
+	// most recently seen first. It is only populated if the Routing Table has a replacement cache.
+	replacements *list.List
 }
 
 func newBucket() *bucket {
 	b := new(bucket)
 	b.list = list.New()
+	b.replacements = list.New()
 	return b
 }
 
@@ -111,13 +116,7 @@ func (b *bucket) getPeer(p peer.ID) *PeerInfo {
 // removes the peer with the given Id from the bucket.
 // returns true if successful, false otherwise.
 func (b *bucket) remove(id peer.ID) bool {
-	for e := b.list.Front(); e != nil; e = e.Next() {
-		if e.Value.(*PeerInfo).Id == id {
-			b.list.Remove(e)
-			return true
-		}
-	}
-	return false
+	return removeFromList(b.list, id)
 }
 
 func (b *bucket) pushFront(p *PeerInfo) {
@@ -128,14 +127,73 @@ func (b *bucket) len() int {
 	return b.list.Len()
 }
 
+// stashReplacement records the given peer as the most recently seen replacement candidate for the bucket,
+// dropping the least recently seen candidates so that no more than max of them are kept.
+func (b *bucket) stashReplacement(p *PeerInfo, max int) {
+	removeFromList(b.replacements, p.Id)
+	b.replacements.PushFront(p)
+	b.trimReplacements(max)
+}
+
+// popReplacement removes and returns the most recently seen replacement candidate.
+// returns nil if there is none.
+func (b *bucket) popReplacement() *PeerInfo {
+	e := b.replacements.Front()
+	if e == nil {
+		return nil
+	}
+	return b.replacements.Remove(e).(*PeerInfo)
+}
+
+// trimReplacements drops the least recently seen replacement candidates until at most max of them are left.
+func (b *bucket) trimReplacements(max int) {
+	for b.replacements.Len() > max {
+		b.replacements.Remove(b.replacements.Back())
+	}
+}
+
+// mergeReplacements moves the replacement candidates of the other bucket behind the ones of this bucket,
+// keeping no more than max of them.
+func (b *bucket) mergeReplacements(other *bucket, max int) {
+	b.replacements.PushBackList(other.replacements)
+	other.replacements.Init()
+	b.trimReplacements(max)
+}
+
+// return the Ids of all the replacement candidates of the bucket, most recently seen first.
+func (b *bucket) replacementIds() []peer.ID {
+	ps := make([]peer.ID, 0, b.replacements.Len())
+	for e := b.replacements.Front(); e != nil; e = e.Next() {
+		ps = append(ps, e.Value.(*PeerInfo).Id)
+	}
+	return ps
+}
+
+// removes the peer with the given Id from the list.
+// returns true if successful, false otherwise.
+func removeFromList(l *list.List, id peer.ID) bool {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(*PeerInfo).Id == id {
+			l.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
 // splits a buckets peers into two buckets, the methods receiver will have
 // peers with CPL equal to cpl, the returned bucket will have peers with CPL
 // greater than cpl (returned bucket has closer peers)
 func (b *bucket) split(cpl int, target ID) *bucket {
-	out := list.New()
 	newbuck := newBucket()
-	newbuck.list = out
-	e := b.list.Front()
+	splitList(b.list, newbuck.list, cpl, target)
+	splitList(b.replacements, newbuck.replacements, cpl, target)
+	return newbuck
+}
+
+// splitList moves the peers with CPL greater than cpl from the in list to the back of the out list.
+func splitList(in, out *list.List, cpl int, target ID) {
+	e := in.Front()
 	for e != nil {
 		pDhtId := e.Value.(*PeerInfo).dhtId
 		peerCPL := CommonPrefixLen(pDhtId, target)
@@ -143,12 +201,11 @@ func (b *bucket) split(cpl int, target ID) *bucket {
 			cur := e
 			out.PushBack(e.Value)
 			e = e.Next()
-			b.list.Remove(cur)
+			in.Remove(cur)
 			continue
 		}
 		e = e.Next()
 	}
-	return newbuck
 }
 
 // maxCommonPrefix returns the maximum common prefix length between any peer in
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/test"
 
 	"github.com/stretchr/testify/require"
@@ -78,3 +79,45 @@ func TestUpdateAllWith(t *testing.T) {
 	require.True(t, b.getPeer(pid2).replaceable)
 	require.True(t, b.getPeer(pid3).replaceable)
 }
+
+func TestBucketReplacements(t *testing.T) {
+	t.Parallel()
+
+	local := ConvertPeerID(test.RandPeerIDFatal(t))
+	b := newBucket()
+	require.Nil(t, b.popReplacement())
+
+	var far, near []peer.ID
+	for len(far) < 2 || len(near) < 2 {
+		p := test.RandPeerIDFatal(t)
+		pi := &PeerInfo{Id: p, dhtId: ConvertPeerID(p)}
+		if CommonPrefixLen(pi.dhtId, local) == 0 {
+			if len(far) == 2 {
+				continue
+			}
+			far = append(far, p)
+		} else {
+			if len(near) == 2 {
+				continue
+			}
+			near = append(near, p)
+		}
+		b.stashReplacement(pi, 10)
+	}
+	require.Len(t, b.replacementIds(), 4)
+
+	// candidates follow their peers when the bucket is split...
+	nb := b.split(0, local)
+	require.ElementsMatch(t, far, b.replacementIds())
+	require.ElementsMatch(t, near, nb.replacementIds())
+
+	// ...and when buckets are merged back, within the limit.
+	b.mergeReplacements(nb, 3)
+	require.Len(t, b.replacementIds(), 3)
+	require.Empty(t, nb.replacementIds())
+
+	pi := b.popReplacement()
+	require.NotNil(t, pi)
+	require.Len(t, b.replacementIds(), 2)
+	require.NotContains(t, b.replacementIds(), pi.Id)
+}
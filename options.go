@@ -0,0 +1,305 @@
+package kbucket
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Option configures optional behaviour of a RoutingTable.
+type Option func(rt *RoutingTable) error
+
+// WithRandSource sets the source of randomness the Routing Table uses for random peer selection.
+// Defaults to a source seeded with the current time.
+func WithRandSource(src rand.Source) Option {
+	return func(rt *RoutingTable) error {
+		if src == nil {
+			return errors.New("rand source can not be nil")
+		}
+		rt.rng = rand.New(src)
+		return nil
+	}
+}
+
+// WithMaxTableSize caps the total number of peers the Routing Table holds across all buckets.
+// What happens to new peers once the cap is reached is decided by the TableFullPolicy,
+// see WithTableFullPolicy. Zero means unlimited, which is the default.
+func WithMaxTableSize(n int) Option {
+	return func(rt *RoutingTable) error {
+		if n < 0 {
+			return errors.New("max table size can not be negative")
+		}
+		rt.maxTableSize = n
+		return nil
+	}
+}
+
+// WithTableFullPolicy sets what the Routing Table does with a new peer once it has reached
+// the size configured with WithMaxTableSize. Defaults to RejectWhenFull.
+func WithTableFullPolicy(policy TableFullPolicy) Option {
+	return func(rt *RoutingTable) error {
+		switch policy {
+		case RejectWhenFull, EvictStalestWhenFull, EvictByScoreWhenFull:
+		default:
+			return fmt.Errorf("unknown table full policy: %d", policy)
+		}
+		rt.tableFullPolicy = policy
+		return nil
+	}
+}
+
+// WithCompositeEvictionWeights sets how the peer evicted under EvictByScoreWhenFull is chosen.
+// Defaults to DefaultCompositeEvictionWeights.
+func WithCompositeEvictionWeights(w CompositeEvictionWeights) Option {
+	return func(rt *RoutingTable) error {
+		if w.Staleness < 0 || w.Latency < 0 {
+			return errors.New("composite eviction weights can not be negative")
+		}
+		rt.evictionWeights = w
+		return nil
+	}
+}
+
+// WithScoreFunc sets how PeerScore rates the peers of the Routing Table. Defaults to DefaultScoreFunc.
+func WithScoreFunc(fn ScoreFunc) Option {
+	return func(rt *RoutingTable) error {
+		if fn == nil {
+			return errors.New("score function can not be nil")
+		}
+		rt.scoreFunc = fn
+		return nil
+	}
+}
+
+// WithRefreshPriorityFunc sets how RefreshPriority ranks the Cpls to refresh. Defaults to DefaultRefreshPriority.
+func WithRefreshPriorityFunc(fn RefreshPriorityFunc) Option {
+	return func(rt *RoutingTable) error {
+		if fn == nil {
+			return errors.New("refresh priority function can not be nil")
+		}
+		rt.refreshPriority = fn
+		return nil
+	}
+}
+
+// WithMaxBucketUnfolds bounds how many buckets a single add unfolds when the last bucket overflows, which
+// happens with the table's write lock held. By default, the table is unfolded until the last bucket no longer
+// overflows, which can take as many splits as there are bits in the local ID when the peers in the last bucket
+// are all close to each other. Once the bound is reached, a peer whose bucket is still full is handled like any
+// peer that finds its bucket full: it takes the place of a replaceable peer of the bucket if there is one, see
+// TryAddPeer, and fails for lack of capacity otherwise. The next adds resume unfolding. Zero means unbounded,
+// which is the default.
+func WithMaxBucketUnfolds(n int) Option {
+	return func(rt *RoutingTable) error {
+		if n < 0 {
+			return errors.New("max bucket unfolds can not be negative")
+		}
+		rt.maxUnfolds = n
+		return nil
+	}
+}
+
+// WithInitialBuckets makes the Routing Table start with n empty buckets instead of one, as if it had already
+// been unfolded n-1 times, e.g. to avoid splitting buckets over and over while restoring a table known to be deep.
+// Like any empty bucket at the end of the table, the buckets that are still empty when a peer is removed are
+// collapsed. n can't exceed the number of possible Cpls with the local ID plus one.
+func WithInitialBuckets(n int) Option {
+	return func(rt *RoutingTable) error {
+		if n < 1 || n > rt.maxBuckets() {
+			return fmt.Errorf("initial buckets must be between 1 and %d", rt.maxBuckets())
+		}
+		rt.buckets = make([]*bucket, n)
+		for i := range rt.buckets {
+			rt.buckets[i] = newBucket()
+		}
+		rt.maxDepthReached = n
+		return nil
+	}
+}
+
+// WithPeerTTL makes the Routing Table evict, in the background, the peers that haven't
+// had a successful outbound query for longer than the given TTL. A newly added peer counts
+// as having been queried when it was added. Zero means peers never expire, which is the default.
+func WithPeerTTL(ttl time.Duration) Option {
+	return func(rt *RoutingTable) error {
+		if ttl < 0 {
+			return errors.New("peer TTL can not be negative")
+		}
+		rt.peerTTL = ttl
+		return nil
+	}
+}
+
+// WithBucketRefreshIntervalFunc gives the peers of each bucket their own TTL in place of the one set with
+// WithPeerTTL, e.g. to check the peers of the high Cpl buckets, which matter the most for lookups, more often.
+// fn is called with a bucket index and a zero return means the bucket uses the uniform TTL, which is the default.
+// It requires WithPeerTTL, as the buckets are only swept when the table has a peer TTL.
+func WithBucketRefreshIntervalFunc(fn func(bucketIndex int) time.Duration) Option {
+	return func(rt *RoutingTable) error {
+		if fn == nil {
+			return errors.New("bucket refresh interval function can not be nil")
+		}
+		rt.bucketTTL = fn
+		return nil
+	}
+}
+
+// WithReplacementCacheSize makes every bucket remember up to n of the most recently seen peers it had
+// to turn away for lack of capacity. When a peer is removed from the bucket, the most recent acceptable
+// candidate is promoted in its place. Zero disables the replacement cache, which is the default.
+func WithReplacementCacheSize(n int) Option {
+	return func(rt *RoutingTable) error {
+		if n < 0 {
+			return errors.New("replacement cache size can not be negative")
+		}
+		rt.replacementCacheSize = n
+		return nil
+	}
+}
+
+// WithLatencyBiasedReplacement makes a new peer that finds its bucket full take the place of the slowest
+// replaceable peer of the bucket, rather than of any replaceable peer, as long as the latency of that peer
+// exceeds its own by at least the given margin. Irreplaceable peers are never displaced, and peers without a
+// latency sample replace a peer as if the option wasn't set. Disabled by default.
+func WithLatencyBiasedReplacement(margin time.Duration) Option {
+	return func(rt *RoutingTable) error {
+		if margin < 0 {
+			return errors.New("latency margin can not be negative")
+		}
+		rt.latencyBiasedReplacement = true
+		rt.latencyMargin = margin
+		return nil
+	}
+}
+
+// WithLatencySampleMaxAge stops the latency gate from trusting latency samples older than maxAge, as told by
+// sampledAt, which returns when the latency of a peer was last measured, or the zero time if it doesn't know.
+// A peer whose sample is too old, or of unknown age, is admitted or rejected according to the policy instead of
+// by its latency. Peers whose latency was never measured are always admitted. By default, every sample is trusted.
+func WithLatencySampleMaxAge(sampledAt func(peer.ID) time.Time, maxAge time.Duration, policy StaleLatencyPolicy) Option {
+	return func(rt *RoutingTable) error {
+		if sampledAt == nil {
+			return errors.New("latency sample time function can not be nil")
+		}
+		if maxAge <= 0 {
+			return errors.New("latency sample max age must be positive")
+		}
+		switch policy {
+		case AdmitStaleLatency, RejectStaleLatency:
+		default:
+			return fmt.Errorf("unknown stale latency policy: %d", policy)
+		}
+		rt.latencySampledAt = sampledAt
+		rt.latencyMaxAge = maxAge
+		rt.staleLatencyPolicy = policy
+		return nil
+	}
+}
+
+// WithEvictionVeto sets a function the background worker started by WithPeerTTL consults right before
+// evicting a peer whose TTL has expired. Returning true cancels the eviction. A vetoed peer keeps its stale
+// LastSuccessfulOutboundQueryAt time, so the veto is consulted again on every sweep until the peer is
+// queried successfully. The function is called with the table lock held and must not call back into the table.
+func WithEvictionVeto(veto func(p peer.ID) bool) Option {
+	return func(rt *RoutingTable) error {
+		rt.evictionVeto = veto
+		return nil
+	}
+}
+
+// WithPeerIDValidation makes the Routing Table reject peers whose ID doesn't decode to a valid
+// multihash, including the empty ID, with ErrInvalidPeerID, both when adding and when reserving them.
+// Disabled by default, as it adds some work to every add.
+func WithPeerIDValidation() Option {
+	return func(rt *RoutingTable) error {
+		rt.validatePeerIDs = true
+		return nil
+	}
+}
+
+// WithConnectedness sets the function the Routing Table uses to find out whether we are connected to a peer,
+// typically the Connectedness method of the host's network. It is called with the table lock released.
+func WithConnectedness(fn func(p peer.ID) network.Connectedness) Option {
+	return func(rt *RoutingTable) error {
+		if fn == nil {
+			return errors.New("connectedness function can not be nil")
+		}
+		rt.connectedness = fn
+		return nil
+	}
+}
+
+// WithAutoPersist makes the Routing Table save its peers to the file at path, in the background, every interval,
+// so that it can be restored with WithPersistedPeers after a restart. Failures to save are logged.
+func WithAutoPersist(path string, interval time.Duration) Option {
+	return func(rt *RoutingTable) error {
+		if path == "" {
+			return errors.New("auto persist path can not be empty")
+		}
+		if interval <= 0 {
+			return errors.New("auto persist interval must be positive")
+		}
+		rt.persistPath = path
+		rt.persistInterval = interval
+		return nil
+	}
+}
+
+// WithPersistedPeers makes the Routing Table start with the peers saved to the file at path by WithAutoPersist,
+// along with their metadata. The peers go through the same checks as when they are added with TryAddPeer.
+// A missing file leaves the table empty and failures to load the file are logged.
+func WithPersistedPeers(path string) Option {
+	return func(rt *RoutingTable) error {
+		if path == "" {
+			return errors.New("persisted peers path can not be empty")
+		}
+		rt.loadPath = path
+		return nil
+	}
+}
+
+// WithBackupTable sets a secondary Routing Table the peers this table evicts on its own are offered to,
+// so they aren't lost entirely. This covers peers replaced by new ones, peers evicted because the table is
+// full and peers evicted for being stale, but not peers removed with RemovePeer.
+// The peers are offered once this table's lock is released, so the callbacks of the backup table can call
+// back into this table.
+func WithBackupTable(backup *RoutingTable) Option {
+	return func(rt *RoutingTable) error {
+		if backup == nil {
+			return errors.New("backup table can not be nil")
+		}
+		rt.backup = backup
+		return nil
+	}
+}
+
+// WithLockMetrics makes the Routing Table record how long callers wait to acquire its lock,
+// for reads and writes separately. The numbers are available through LockStats. Disabled by default.
+func WithLockMetrics() Option {
+	return func(rt *RoutingTable) error {
+		rt.lockMetrics = new(lockMetrics)
+		return nil
+	}
+}
+
+// WithDebouncedNotifications makes the Routing Table deliver the peers added to and removed from it in
+// batches, at most once per interval, in addition to the PeerAdded and PeerRemoved callbacks.
+// A peer that is added and removed again between two batches appears in neither of them, and the peers
+// of a batch come in no particular order. The function is called without the table lock held, one batch
+// at a time. Closing the table delivers the notifications still pending.
+func WithDebouncedNotifications(interval time.Duration, fn func(added, removed []peer.ID)) Option {
+	return func(rt *RoutingTable) error {
+		if interval <= 0 {
+			return errors.New("debounce interval must be positive")
+		}
+		if fn == nil {
+			return errors.New("debounced notification function can not be nil")
+		}
+		rt.debouncer = newDebouncer(interval, fn)
+		return nil
+	}
+}
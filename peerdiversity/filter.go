@@ -141,6 +141,17 @@ func (f *Filter) Remove(p peer.ID) {
 
 // TryAdd attempts to add the peer to the Filter state and returns true if it's successful, false otherwise.
 func (f *Filter) TryAdd(p peer.ID) bool {
+	return f.add(p, false)
+}
+
+// Add adds the peer to the Filter state like TryAdd, but without asking the PeerIPGroupFilter whether its groups
+// allow it, so that the peer counts towards its groups even past their limits. It returns false if the groups of
+// the peer can't be determined, in which case the peer isn't added.
+func (f *Filter) Add(p peer.ID) bool {
+	return f.add(p, true)
+}
+
+func (f *Filter) add(p peer.ID, force bool) bool {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -179,7 +190,7 @@ func (f *Filter) TryAdd(p peer.ID) bool {
 		}
 		group := PeerGroupInfo{Id: p, Cpl: cpl, IPGroupKey: key}
 
-		if !f.pgm.Allow(group) {
+		if !force && !f.pgm.Allow(group) {
 			return false
 		}
 
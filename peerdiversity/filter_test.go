@@ -231,6 +231,29 @@ func (m *mockAsnStore) AsnForIPv6(net.IP) (string, error) {
 	return m.reply, nil
 }
 
+func TestFilterAdd(t *testing.T) {
+	m := newMockPeerGroupFilter()
+	m.peerAddressFunc = func(id peer.ID) []ma.Multiaddr {
+		if id == "p1" {
+			return []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/0")}
+		}
+		return nil
+	}
+	f, err := NewFilter(m, "test", func(p peer.ID) int { return 1 })
+	require.NoError(t, err)
+
+	// the peer is counted although its group doesn't allow it...
+	require.False(t, f.TryAdd("p1"))
+	require.True(t, f.Add("p1"))
+	require.Contains(t, m.increments, peer.ID("p1"))
+	f.Remove("p1")
+	require.Contains(t, m.decrements, peer.ID("p1"))
+
+	// ...but not if its group can't be determined.
+	require.False(t, f.Add("p2"))
+	require.NotContains(t, m.increments, peer.ID("p2"))
+}
+
 func TestIPGroupKey(t *testing.T) {
 	f, err := NewFilter(newMockPeerGroupFilter(), "test", func(p peer.ID) int { return 1 })
 	f.asnStore = &mockAsnStore{"test"}
@@ -0,0 +1,89 @@
+package kbucket
+
+import (
+	"container/list"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RTSnapshot is an immutable copy of a Routing Table taken at a point in time.
+//
+// Queries on a snapshot don't take any lock, so they never contend with each other nor with writers of
+// the table it was taken from. In exchange, a snapshot doesn't see any change made to the table after it
+// was taken: callers are expected to take a fresh snapshot periodically, with a period matching how stale
+// they can afford their answers to be. A snapshot is safe for concurrent use.
+type RTSnapshot struct {
+	local      ID
+	bucketsize int
+	buckets    []*bucket
+	peers      map[peer.ID]struct{}
+}
+
+// ReadOnlySnapshot returns an immutable snapshot of the Routing Table.
+// Taking it copies the whole table under the read lock.
+func (rt *RoutingTable) ReadOnlySnapshot() *RTSnapshot {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	s := &RTSnapshot{
+		local:      rt.local,
+		bucketsize: rt.bucketsize,
+		buckets:    make([]*bucket, 0, len(rt.buckets)),
+		peers:      make(map[peer.ID]struct{}, rt.size()),
+	}
+	for _, b := range rt.buckets {
+		// the snapshot only needs the identity of the peers, so it doesn't copy any replacement candidates.
+		cb := &bucket{list: list.New(), replacements: list.New()}
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := *e.Value.(*PeerInfo)
+			cb.list.PushBack(&p)
+			s.peers[p.Id] = struct{}{}
+		}
+		s.buckets = append(s.buckets, cb)
+	}
+	return s
+}
+
+// Size returns the number of peers in the snapshot.
+func (s *RTSnapshot) Size() int {
+	return len(s.peers)
+}
+
+// Contains returns whether the peer was in the Routing Table when the snapshot was taken.
+func (s *RTSnapshot) Contains(p peer.ID) bool {
+	_, ok := s.peers[p]
+	return ok
+}
+
+// NearestPeers returns a list of the 'count' closest peers to the given ID,
+// as RoutingTable.NearestPeers would have when the snapshot was taken.
+func (s *RTSnapshot) NearestPeers(id ID, count int) []peer.ID {
+	var pds []peerDistance
+	if count <= nearestPeersHeapMaxCount {
+		pdh := peerDistanceHeap{
+			peers:  make([]peerDistance, 0, count),
+			target: id,
+			count:  count,
+		}
+		collectNearestFrom(s.buckets, s.local, &pdh, id, count)
+		pds = pdh.sorted()
+	} else {
+		pdsr := peerDistanceSorter{
+			peers:  make([]peerDistance, 0, count+s.bucketsize),
+			target: id,
+		}
+		collectNearestFrom(s.buckets, s.local, &pdsr, id, count)
+		pdsr.sort()
+		pds = pdsr.peers
+	}
+
+	if count < len(pds) {
+		pds = pds[:count]
+	}
+
+	out := make([]peer.ID, 0, len(pds))
+	for _, p := range pds {
+		out = append(out, p.p)
+	}
+	return out
+}
@@ -0,0 +1,101 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlySnapshot(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	empty := rt.ReadOnlySnapshot()
+	require.Zero(t, empty.Size())
+	require.Empty(t, empty.NearestPeers(ConvertPeerID(local), 10))
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	snap := rt.ReadOnlySnapshot()
+	require.Equal(t, rt.Size(), snap.Size())
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		for _, count := range []int{1, 10, 100} {
+			require.Equal(t, rt.NearestPeers(id, count), snap.NearestPeers(id, count))
+		}
+	}
+
+	// later changes to the table aren't visible in the snapshot.
+	removed := rt.ListPeers()[0]
+	rt.RemovePeer(removed)
+	added := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(added, true, false)
+	require.True(t, snap.Contains(removed))
+	require.False(t, snap.Contains(added))
+	require.False(t, rt.ReadOnlySnapshot().Contains(removed))
+}
+
+// BenchmarkSnapshotNearestPeersParallel answers queries from a snapshot from many goroutines at once
+// while another goroutine keeps writing to the table, compare with BenchmarkNearestPeersConcurrentAdds.
+func BenchmarkSnapshotNearestPeersParallel(b *testing.B) {
+	b.StopTimer()
+	local := ConvertKey("localKey")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	require.NoError(b, err)
+
+	for i := 0; i < 10000; i++ {
+		tab.TryAddPeer(test.RandPeerIDFatal(b), true, false)
+	}
+	targets := make([]ID, 1000)
+	for i := range targets {
+		targets[i] = ConvertPeerID(test.RandPeerIDFatal(b))
+	}
+	churn := make([]peer.ID, 1000)
+	for i := range churn {
+		churn[i] = test.RandPeerIDFatal(b)
+	}
+	snap := tab.ReadOnlySnapshot()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p := churn[i%len(churn)]
+			if i/len(churn)%2 == 0 {
+				tab.TryAddPeer(p, true, false)
+			} else {
+				tab.RemovePeer(p)
+			}
+		}
+	}()
+
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			snap.NearestPeers(targets[i%len(targets)], 20)
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
+}
@@ -1,6 +1,8 @@
 package kbucket
 
 import (
+	"bytes"
+	"container/heap"
 	"container/list"
 	"sort"
 
@@ -13,10 +15,41 @@ type peerDistance struct {
 	distance ID
 }
 
+// closer tells whether pd comes before other in a nearest peers query. Peers at the same distance, which only
+// happens when they have the same DHT ID, are ordered by their peer ID so that the order is deterministic.
+func (pd peerDistance) closer(other peerDistance) bool {
+	if !bytes.Equal(pd.distance, other.distance) {
+		return pd.distance.less(other.distance)
+	}
+	return pd.p < other.p
+}
+
+// peerCollector gathers candidate peers for a nearest peers query.
+type peerCollector interface {
+	Len() int
+	appendPeersFromList(l *list.List)
+}
+
+// peerIDCollector gathers candidate peers as they come, without computing their distance to the target.
+type peerIDCollector struct {
+	peers []peer.ID
+}
+
+func (pic *peerIDCollector) Len() int { return len(pic.peers) }
+
+// Append the peer.ID values in the list to the collector's slice.
+func (pic *peerIDCollector) appendPeersFromList(l *list.List) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		pic.peers = append(pic.peers, e.Value.(*PeerInfo).Id)
+	}
+}
+
 // peerDistanceSorter implements sort.Interface to sort peers by xor distance
 type peerDistanceSorter struct {
 	peers  []peerDistance
 	target ID
+	// keep, if set, tells which of the peers appended from a list are kept.
+	keep func(p *PeerInfo) bool
 }
 
 func (pds *peerDistanceSorter) Len() int { return len(pds.peers) }
@@ -24,7 +57,7 @@ func (pds *peerDistanceSorter) Swap(a, b int) {
 	pds.peers[a], pds.peers[b] = pds.peers[b], pds.peers[a]
 }
 func (pds *peerDistanceSorter) Less(a, b int) bool {
-	return pds.peers[a].distance.less(pds.peers[b].distance)
+	return pds.peers[a].closer(pds.peers[b])
 }
 
 // Append the peer.ID to the sorter's slice. It may no longer be sorted.
@@ -38,7 +71,9 @@ func (pds *peerDistanceSorter) appendPeer(p peer.ID, pDhtId ID) {
 // Append the peer.ID values in the list to the sorter's slice. It may no longer be sorted.
 func (pds *peerDistanceSorter) appendPeersFromList(l *list.List) {
 	for e := l.Front(); e != nil; e = e.Next() {
-		pds.appendPeer(e.Value.(*PeerInfo).Id, e.Value.(*PeerInfo).dhtId)
+		if pi := e.Value.(*PeerInfo); pds.keep == nil || pds.keep(pi) {
+			pds.appendPeer(pi.Id, pi.dhtId)
+		}
 	}
 }
 
@@ -46,6 +81,75 @@ func (pds *peerDistanceSorter) sort() {
 	sort.Sort(pds)
 }
 
+// peerDistanceHeap is a bounded max-heap of peers keyed by their xor distance to the target.
+// It keeps only the 'count' closest peers offered to it, which lets us select the nearest
+// peers for small counts without sorting every candidate.
+type peerDistanceHeap struct {
+	peers  []peerDistance
+	target ID
+	count  int
+	// keep, if set, tells which of the peers offered from a list are kept.
+	keep func(p *PeerInfo) bool
+}
+
+func (pdh *peerDistanceHeap) Len() int { return len(pdh.peers) }
+func (pdh *peerDistanceHeap) Swap(a, b int) {
+	pdh.peers[a], pdh.peers[b] = pdh.peers[b], pdh.peers[a]
+}
+
+// the farthest peer sits at the root so it can be evicted cheaply.
+func (pdh *peerDistanceHeap) Less(a, b int) bool {
+	return pdh.peers[b].closer(pdh.peers[a])
+}
+func (pdh *peerDistanceHeap) Push(x interface{}) {
+	pdh.peers = append(pdh.peers, x.(peerDistance))
+}
+func (pdh *peerDistanceHeap) Pop() interface{} {
+	last := len(pdh.peers) - 1
+	x := pdh.peers[last]
+	pdh.peers = pdh.peers[:last]
+	return x
+}
+
+// offerPeer adds the peer to the heap if it's closer than the farthest peer we're holding,
+// or if the heap isn't full yet.
+func (pdh *peerDistanceHeap) offerPeer(p peer.ID, pDhtId ID) {
+	if pdh.count <= 0 {
+		return
+	}
+
+	pd := peerDistance{
+		p:        p,
+		distance: xor(pdh.target, pDhtId),
+	}
+	if len(pdh.peers) < pdh.count {
+		heap.Push(pdh, pd)
+		return
+	}
+	if pd.closer(pdh.peers[0]) {
+		pdh.peers[0] = pd
+		heap.Fix(pdh, 0)
+	}
+}
+
+// Offer the peer.ID values in the list to the heap.
+func (pdh *peerDistanceHeap) appendPeersFromList(l *list.List) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if pi := e.Value.(*PeerInfo); pdh.keep == nil || pdh.keep(pi) {
+			pdh.offerPeer(pi.Id, pi.dhtId)
+		}
+	}
+}
+
+// sorted drains the heap and returns the peers it held in ascending order of distance.
+func (pdh *peerDistanceHeap) sorted() []peerDistance {
+	out := make([]peerDistance, len(pdh.peers))
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(pdh).(peerDistance)
+	}
+	return out
+}
+
 // SortClosestPeers Sort the given peers by their ascending distance from the target. A new slice is returned.
 func SortClosestPeers(peers []peer.ID, target ID) []peer.ID {
 	sorter := peerDistanceSorter{
@@ -2,14 +2,22 @@
 package kbucket
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/minio/sha256-simd"
 
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 
@@ -20,6 +28,49 @@ var log = logging.Logger("table")
 
 var ErrPeerRejectedHighLatency = errors.New("peer rejected; latency too high")
 var ErrPeerRejectedNoCapacity = errors.New("peer rejected; insufficient capacity")
+var ErrTableFull = errors.New("peer rejected; routing table is full")
+var ErrInvalidPeerID = errors.New("peer rejected; invalid peer ID")
+var ErrTableClosed = errors.New("routing table is closed")
+
+// splitHistorySize is the number of bucket splits the Routing Table remembers.
+const splitHistorySize = 128
+
+// SplitEvent records a split of the last bucket of the Routing Table.
+type SplitEvent struct {
+	// At is the time of the split.
+	At time.Time
+	// Bucket is the index of the bucket created by the split.
+	Bucket int
+}
+
+// TableFullPolicy decides what happens to a new peer when the Routing Table has reached its maximum size.
+type TableFullPolicy int
+
+const (
+	// RejectWhenFull rejects new peers with ErrTableFull.
+	RejectWhenFull TableFullPolicy = iota
+	// EvictStalestWhenFull evicts the replaceable peer with the oldest LastSuccessfulOutboundQueryAt
+	// across all buckets to make room for the new peer. Without a replaceable peer, the new peer is
+	// rejected with ErrTableFull.
+	EvictStalestWhenFull
+	// EvictByScoreWhenFull evicts the replaceable peer with the highest eviction score across all buckets to
+	// make room for the new peer, weighing staleness and latency as set with WithCompositeEvictionWeights.
+	// Without a replaceable peer, the new peer is rejected with ErrTableFull.
+	EvictByScoreWhenFull
+)
+
+// CompositeEvictionWeights tunes how much each trait of a peer counts towards its eviction score under
+// EvictByScoreWhenFull. The peer with the highest score is evicted, a zero weight ignores the trait.
+type CompositeEvictionWeights struct {
+	// Staleness weighs each second elapsed since the LastSuccessfulOutboundQueryAt of the peer.
+	Staleness float64
+	// Latency weighs each millisecond of the latency EWMA of the peer.
+	Latency float64
+}
+
+// DefaultCompositeEvictionWeights are the weights EvictByScoreWhenFull uses unless set otherwise,
+// with a millisecond of latency counting as much as a second of staleness.
+var DefaultCompositeEvictionWeights = CompositeEvictionWeights{Staleness: 1, Latency: 1}
 
 // RoutingTable defines the routing table.
 type RoutingTable struct {
@@ -32,6 +83,7 @@ type RoutingTable struct {
 	local ID
 
 	// Blanket lock, refine later for better performance
+	// acquire it through lockTable and rlockTable so that it can be instrumented.
 	tabLock sync.RWMutex
 
 	// latency metrics
@@ -44,59 +96,283 @@ type RoutingTable struct {
 	buckets    []*bucket
 	bucketsize int
 
+	// the most recent bucket splits, oldest first once the ring buffer has wrapped around.
+	splitHistory     []SplitEvent
+	splitHistoryNext int
+	// the largest number of buckets the table ever had.
+	maxDepthReached int
+
+	// maximum number of buckets a single call to nextBucket unfolds, zero means unlimited.
+	maxUnfolds int
+
+	// maximum number of peers across all buckets, zero means unlimited.
+	maxTableSize    int
+	tableFullPolicy TableFullPolicy
+	evictionWeights CompositeEvictionWeights
+
+	// rates the peers for PeerScore.
+	scoreFunc ScoreFunc
+
+	// maximum number of replacement candidates kept per bucket, zero disables the replacement cache.
+	replacementCacheSize int
+
+	// if set, a new peer can replace a peer that is slower than it by at least latencyMargin.
+	latencyBiasedReplacement bool
+	latencyMargin            time.Duration
+
+	// when set, the latency samples older than latencyMaxAge are handled per staleLatencyPolicy.
+	latencySampledAt   func(peer.ID) time.Time
+	latencyMaxAge      time.Duration
+	staleLatencyPolicy StaleLatencyPolicy
+
 	cplRefreshLk   sync.RWMutex
 	cplRefreshedAt map[uint]time.Time
+	// ranks the Cpls for RefreshPriority.
+	refreshPriority RefreshPriorityFunc
 
-	// notification functions
+	// notification functions, they are called once the table lock has been released, so they
+	// can call back into the table. A nil function is a no-op.
 	PeerRemoved func(peer.ID)
 	PeerAdded   func(peer.ID)
 
+	// CplPopulated is called when a peer is added with a Cpl no other peer in the table has. A nil function is a no-op.
+	CplPopulated func(cpl uint)
+
+	// channels returned by Subscribe.
+	subscribers subscribers
+
+	// functions registered with OnPeerAdded and OnPeerRemoved, notified after the fields above.
+	addedListeners   peerListeners
+	removedListeners peerListeners
+
+	// OnClosestPeerChanged, if set, is called when the peer in the table closest to us changes, with the empty ID
+	// standing for no peer. Keeping track of it costs a distance comparison per added peer, and a scan of the last
+	// non-empty bucket when the closest peer is removed. Like the other notifications, it's called once the table
+	// lock has been released.
+	OnClosestPeerChanged func(old, new peer.ID)
+	// the peer in the table closest to us.
+	closestToSelf peer.ID
+	closestDhtId  ID
+
+	// notifications queued while the table lock is held, see unlockTable.
+	pendingNotifications []func()
+
+	// CanRemovePeer, if set, is consulted before any peer is removed from the table, whether by RemovePeer
+	// or to make room for another peer or because it's stale. Returning false keeps the peer in the table.
+	// It is called with the table lock held and must not call back into the table.
+	CanRemovePeer func(peer.ID) bool
+
 	// usefulnessGracePeriod is the maximum grace period we will give to a
 	// peer in the bucket to be useful to us, failing which, we will evict
 	// it to make place for a new peer if the bucket is full
 	usefulnessGracePeriod time.Duration
 
 	df *peerdiversity.Filter
+
+	// peers that haven't had a successful outbound query for this long are evicted, zero means never.
+	peerTTL time.Duration
+	// bucketTTL, if set, overrides peerTTL for the peers of a given bucket index.
+	bucketTTL func(bucketIndex int) time.Duration
+
+	// sweepTrigger asks the background worker for an immediate sweep, and nextSweepDone
+	// is closed once the next sweep to start has completed.
+	sweepTrigger  chan struct{}
+	sweepLk       sync.Mutex
+	nextSweepDone chan struct{}
+	// when the background worker last woke up for a sweep and last completed one, and whether it is still running.
+	lastSweepAt     time.Time
+	lastSweepDoneAt time.Time
+	sweeperRunning  bool
+	// how many peers the last completed sweep checked and evicted.
+	lastSweepChecked int
+	lastSweepEvicted int
+
+	// where and how often the table is saved, see WithAutoPersist, and where it's loaded from on creation.
+	persistPath     string
+	persistInterval time.Duration
+	loadPath        string
+
+	// reports whether we are connected to a peer, nil if unknown.
+	connectedness func(peer.ID) network.Connectedness
+
+	// if set, peers whose ID isn't a valid multihash are rejected.
+	validatePeerIDs bool
+
+	// the table the peers we evict are offered to, nil if none.
+	backup *RoutingTable
+
+	// delivers batched add and remove notifications, nil unless enabled with WithDebouncedNotifications.
+	debouncer *debouncer
+
+	// slots held for peers that aren't in the table yet, see Reserve.
+	reservations   map[peer.ID]reservation
+	reservationSeq uint64
+
+	// closed when a peer is removed, created on demand by the adds waiting for room.
+	peerRemovedCh chan struct{}
+
+	// time spent waiting for tabLock, nil unless enabled with WithLockMetrics.
+	lockMetrics *lockMetrics
+
+	// set by Close, after which peers are no longer added or removed.
+	closed bool
+
+	// lifetime event counters, accessed atomically.
+	counters *tableCounters
+
+	// evictionVeto can spare a peer the background worker is about to evict, nil means no veto.
+	evictionVeto func(peer.ID) bool
+
+	rngLk sync.Mutex
+	rng   *rand.Rand
 }
 
 // NewRoutingTable creates a new routing table with a given bucketsize, local ID, and latency tolerance.
 func NewRoutingTable(bucketsize int, localID ID, latency time.Duration, m peerstore.Metrics, usefulnessGracePeriod time.Duration,
-	df *peerdiversity.Filter) (*RoutingTable, error) {
+	df *peerdiversity.Filter, opts ...Option) (*RoutingTable, error) {
+	if bucketsize <= 0 {
+		return nil, fmt.Errorf("bucket size must be positive, got %d", bucketsize)
+	}
+	if latency < 0 {
+		return nil, fmt.Errorf("maximum latency can not be negative, got %s", latency)
+	}
+	if m == nil {
+		return nil, errors.New("peer metrics can not be nil")
+	}
+
 	rt := &RoutingTable{
-		buckets:    []*bucket{newBucket()},
+		buckets:         []*bucket{newBucket()},
+		maxDepthReached: 1,
+
+		evictionWeights: DefaultCompositeEvictionWeights,
+		scoreFunc:       DefaultScoreFunc,
+
 		bucketsize: bucketsize,
 		local:      localID,
 
 		maxLatency: latency,
 		metrics:    m,
 
-		cplRefreshedAt: make(map[uint]time.Time),
+		cplRefreshedAt:  make(map[uint]time.Time),
+		refreshPriority: DefaultRefreshPriority,
 
 		PeerRemoved: func(peer.ID) {},
 		PeerAdded:   func(peer.ID) {},
 
+		CplPopulated: func(uint) {},
+
 		usefulnessGracePeriod: usefulnessGracePeriod,
 
 		df: df,
+
+		counters: new(tableCounters),
+
+		sweepTrigger:  make(chan struct{}, 1),
+		nextSweepDone: make(chan struct{}),
+
+		rng: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, opt := range opts {
+		if err := opt(rt); err != nil {
+			return nil, err
+		}
+	}
+
+	if rt.bucketTTL != nil && rt.peerTTL == 0 {
+		return nil, errors.New("per bucket refresh intervals require a peer TTL")
+	}
+
+	if rt.loadPath != "" {
+		if err := rt.loadFrom(rt.loadPath); err != nil {
+			log.Warnf("failed to load the persisted routing table from %s: %s", rt.loadPath, err)
+		}
 	}
 
 	rt.ctx, rt.ctxCancel = context.WithCancel(context.Background())
 
+	if rt.peerTTL > 0 {
+		rt.sweeperRunning = true
+		go rt.expirePeers()
+	}
+	if rt.persistPath != "" {
+		go rt.autoPersist()
+	}
+
 	return rt, nil
 }
 
 // Close shuts down the Routing Table & all associated processes.
 // It is safe to call this multiple times.
+// Once closed, peers can no longer be added to or removed from the table: adds fail with ErrTableClosed,
+// including the ones waiting in TryAddPeerBlocking, and removals do nothing. Any other change to the table,
+// such as updating the metadata of its peers or restructuring its buckets, does nothing either, and the
+// methods reporting whether a peer was found return false. The table can still be read, and keeps the
+// peers it had, as they were, when it was closed.
 func (rt *RoutingTable) Close() error {
 	rt.ctxCancel()
+	rt.lockTable()
+	rt.closed = true
+	rt.notifyRoom()
+	rt.unlockTable()
+	rt.subscribers.close()
+	if rt.debouncer != nil {
+		rt.debouncer.close()
+	}
 	return nil
 }
 
 // NPeersForCpl returns the number of peers we have for a given Cpl
 func (rt *RoutingTable) NPeersForCpl(cpl uint) int {
-	rt.tabLock.RLock()
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	return rt.nPeersForCpl(cpl)
+}
+
+// HasBucketForCpl returns whether the table has been unfolded enough to have a dedicated bucket for the given Cpl.
+// Peers with a Cpl that doesn't have a dedicated bucket yet all live in the last (wildcard) bucket.
+func (rt *RoutingTable) HasBucketForCpl(cpl uint) bool {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	return int(cpl) < len(rt.buckets)-1
+}
+
+// HasCapacityAtCpl returns whether a peer with the given Cpl could currently be admitted to the Routing Table:
+// its bucket has room, or it's the last bucket and splitting it would make room, or the bucket has a replaceable
+// peer the new peer could evict. It's an estimate meant to tell whether looking for peers with that Cpl is
+// worthwhile: unlike TryAddPeer, it doesn't know the peer, so it doesn't account for the latency and diversity
+// checks.
+func (rt *RoutingTable) HasCapacityAtCpl(cpl uint) bool {
+	rt.rlockTable()
 	defer rt.tabLock.RUnlock()
 
+	if rt.maxTableSize > 0 && rt.tableFullPolicy == RejectWhenFull && rt.tableLoad() >= rt.maxTableSize {
+		return false
+	}
+
+	bucketID := len(rt.buckets) - 1
+	if int(cpl) < bucketID {
+		bucketID = int(cpl)
+	}
+	if rt.occupied(bucketID) < rt.bucketsize {
+		return true
+	}
+	// splitting the last bucket leaves the peer in a bucket with the peers that share its Cpl.
+	if bucketID == len(rt.buckets)-1 && len(rt.buckets) < rt.maxBuckets() && rt.nPeersForCpl(cpl) < rt.bucketsize {
+		return true
+	}
+	for _, p := range rt.buckets[bucketID].peers() {
+		if p.replaceable {
+			return true
+		}
+	}
+	return false
+}
+
+// the caller is responsible for the locking
+func (rt *RoutingTable) nPeersForCpl(cpl uint) int {
 	// it's in the last bucket
 	if int(cpl) >= len(rt.buckets)-1 {
 		count := 0
@@ -126,6 +402,9 @@ func (rt *RoutingTable) NPeersForCpl(cpl uint) int {
 // If the logical bucket to which the peer belongs is full and it's not the last bucket, we try to replace an existing peer
 // whose LastSuccessfulOutboundQuery is above the maximum allowed threshold in that bucket with the new peer.
 // If no such peer exists in that bucket, we do NOT add the peer to the Routing Table and return error "ErrPeerRejectedNoCapacity".
+//
+// If the Routing Table has been configured with a maximum size and adding the peer would exceed it, we either reject the peer
+// with error "ErrTableFull" or evict the stalest peer in the table to make room for it, depending on the TableFullPolicy.
 
 // TryAddPeer returns a boolean value set to true if the peer was newly added to the Routing Table, false otherwise.
 // It also returns any error that occurred while adding the peer to the Routing Table. If the error is not nil,
@@ -133,15 +412,96 @@ func (rt *RoutingTable) NPeersForCpl(cpl uint) int {
 //
 // A return value of false with error=nil indicates that the peer ALREADY exists in the Routing Table.
 func (rt *RoutingTable) TryAddPeer(p peer.ID, queryPeer bool, isReplaceable bool) (bool, error) {
-	rt.tabLock.Lock()
-	defer rt.tabLock.Unlock()
+	return rt.TryAddPeerCtx(context.Background(), p, queryPeer, isReplaceable)
+}
+
+// TryAddPeerCtx is like TryAddPeer but gives up as soon as the given context is done, returning ctx.Err().
+// The context is checked before and after waiting for the table lock and before the peer goes through
+// the diversity filter. Once the peer has been admitted, the add completes regardless of the context.
+func (rt *RoutingTable) TryAddPeerCtx(ctx context.Context, p peer.ID, queryPeer bool, isReplaceable bool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
-	return rt.addPeer(p, queryPeer, isReplaceable)
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	b, err := rt.addPeer(ctx, p, queryPeer, isReplaceable, true)
+	rt.countRejection(err)
+	return b, err
+}
+
+// TryAddPeerBlocking is like TryAddPeerCtx but, instead of failing when there is no room for the peer,
+// it waits for peers to be removed from the table and tries again, until the peer is added, it's rejected
+// for another reason or the context is done.
+func (rt *RoutingTable) TryAddPeerBlocking(ctx context.Context, p peer.ID, queryPeer bool, isReplaceable bool) (bool, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		rt.lockTable()
+		b, err := rt.addPeer(ctx, p, queryPeer, isReplaceable, true)
+		if err != ErrPeerRejectedNoCapacity && err != ErrTableFull {
+			rt.countRejection(err)
+			rt.unlockTable()
+			return b, err
+		}
+		if rt.peerRemovedCh == nil {
+			rt.peerRemovedCh = make(chan struct{})
+		}
+		removed := rt.peerRemovedCh
+		rt.unlockTable()
+
+		select {
+		case <-removed:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
 }
 
+// notifyRoom wakes up the adds waiting for room in the table.
 // locking is the responsibility of the caller
-func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (bool, error) {
-	bucketID := rt.bucketIdForPeer(p)
+func (rt *RoutingTable) notifyRoom() {
+	if rt.peerRemovedCh != nil {
+		close(rt.peerRemovedCh)
+		rt.peerRemovedCh = nil
+	}
+}
+
+// countRejection updates the rejection counters for the error returned by addPeer.
+func (rt *RoutingTable) countRejection(err error) {
+	switch err {
+	case ErrPeerRejectedHighLatency:
+		atomic.AddUint64(&rt.counters.rejectedHighLatency, 1)
+	case ErrPeerRejectedNoCapacity, ErrTableFull:
+		atomic.AddUint64(&rt.counters.rejectedNoCapacity, 1)
+	}
+}
+
+// addPeer adds the peer to the Routing Table. Unless evict is true, the peer is rejected for lack of capacity
+// instead of replacing a peer of its bucket or, when the table is full, of the table.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) addPeer(ctx context.Context, p peer.ID, queryPeer bool, isReplaceable bool, evict bool) (bool, error) {
+	if rt.closed {
+		return false, ErrTableClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if rt.validatePeerIDs {
+		if _, err := peer.IDFromBytes([]byte(p)); err != nil {
+			return false, ErrInvalidPeerID
+		}
+	}
+
+	// hash the peer ID once and reuse it for every bucket lookup below.
+	// the hash stays on the stack, it's only copied to the heap if the peer makes it into the table.
+	hash := sha256.Sum256([]byte(p))
+	dhtId := ID(hash[:])
+	bucketID := rt.bucketIdForDhtId(dhtId)
 	bucket := rt.buckets[bucketID]
 
 	now := time.Now()
@@ -156,16 +516,33 @@ func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (
 		// usefulness bump. This will ONLY happen once.
 		if peerInfo.LastUsefulAt.IsZero() && queryPeer {
 			peerInfo.LastUsefulAt = lastUsefulAt
+			rt.subscribers.publish(PeerUpdatedChange, p)
 		}
 		return false, nil
 	}
 
+	// a peer added without going through CommitReservation takes the slot reserved for it, if any,
+	// which is given back if the peer doesn't make it into the table.
+	if r, ok := rt.reservations[p]; ok {
+		delete(rt.reservations, p)
+		defer func() {
+			if rt.buckets[rt.bucketIdForDhtId(dhtId)].getPeer(p) == nil {
+				rt.reservations[p] = r
+			}
+		}()
+	}
+
 	// peer's latency threshold is NOT acceptable
-	if rt.metrics.LatencyEWMA(p) > rt.maxLatency {
+	latency, ok := rt.admissionLatency(p)
+	if !ok {
 		// Connection doesnt meet requirements, skip!
 		return false, ErrPeerRejectedHighLatency
 	}
 
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	// add it to the diversity filter for now.
 	// if we aren't able to find a place for the peer in the table,
 	// we will simply remove it from the Filter later.
@@ -176,16 +553,20 @@ func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (
 	}
 
 	// We have enough space in the bucket (whether spawned or grouped).
-	if bucket.len() < rt.bucketsize {
-		bucket.pushFront(&PeerInfo{
+	if rt.occupied(bucketID) < rt.bucketsize {
+		if err := rt.pushNewPeer(bucket, evict, &PeerInfo{
 			Id:                            p,
 			LastUsefulAt:                  lastUsefulAt,
 			LastSuccessfulOutboundQueryAt: now,
 			AddedAt:                       now,
-			dhtId:                         ConvertPeerID(p),
+			dhtId:                         append(ID(nil), dhtId...),
 			replaceable:                   isReplaceable,
-		})
-		rt.PeerAdded(p)
+		}); err != nil {
+			if rt.df != nil {
+				rt.df.Remove(p)
+			}
+			return false, err
+		}
 		return true, nil
 	}
 
@@ -193,20 +574,24 @@ func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (
 		// if the bucket is too large and this is the last bucket (i.e. wildcard), unfold it.
 		rt.nextBucket()
 		// the structure of the table has changed, so let's recheck if the peer now has a dedicated bucket.
-		bucketID = rt.bucketIdForPeer(p)
+		bucketID = rt.bucketIdForDhtId(dhtId)
 		bucket = rt.buckets[bucketID]
 
 		// push the peer only if the bucket isn't overflowing after slitting
-		if bucket.len() < rt.bucketsize {
-			bucket.pushFront(&PeerInfo{
+		if rt.occupied(bucketID) < rt.bucketsize {
+			if err := rt.pushNewPeer(bucket, evict, &PeerInfo{
 				Id:                            p,
 				LastUsefulAt:                  lastUsefulAt,
 				LastSuccessfulOutboundQueryAt: now,
 				AddedAt:                       now,
-				dhtId:                         ConvertPeerID(p),
+				dhtId:                         append(ID(nil), dhtId...),
 				replaceable:                   isReplaceable,
-			})
-			rt.PeerAdded(p)
+			}); err != nil {
+				if rt.df != nil {
+					rt.df.Remove(p)
+				}
+				return false, err
+			}
 			return true, nil
 		}
 	}
@@ -215,22 +600,26 @@ func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (
 	// in that bucket which is replaceable.
 	// we don't really need a stable sort here as it dosen't matter which peer we evict
 	// as long as it's a replaceable peer.
-	replaceablePeer := bucket.min(func(p1 *PeerInfo, p2 *PeerInfo) bool {
-		return p1.replaceable
-	})
+	var replaceablePeer *PeerInfo
+	if evict {
+		// if so configured, a much slower replaceable peer is the first to make way for the new peer.
+		if replaceablePeer = rt.slowerPeer(bucket, latency); replaceablePeer == nil {
+			replaceablePeer = bucket.min(func(p1 *PeerInfo, p2 *PeerInfo) bool {
+				return p1.replaceable
+			})
+		}
+	}
 
 	if replaceablePeer != nil && replaceablePeer.replaceable {
-		// let's evict it and add the new peer
-		if rt.removePeer(replaceablePeer.Id) {
-			bucket.pushFront(&PeerInfo{
-				Id:                            p,
-				LastUsefulAt:                  lastUsefulAt,
-				LastSuccessfulOutboundQueryAt: now,
-				AddedAt:                       now,
-				dhtId:                         ConvertPeerID(p),
-				replaceable:                   isReplaceable,
-			})
-			rt.PeerAdded(p)
+		// let's evict it and add the new peer.
+		if rt.replacePeer(bucket, replaceablePeer, &PeerInfo{
+			Id:                            p,
+			LastUsefulAt:                  lastUsefulAt,
+			LastSuccessfulOutboundQueryAt: now,
+			AddedAt:                       now,
+			dhtId:                         append(ID(nil), dhtId...),
+			replaceable:                   isReplaceable,
+		}) {
 			return true, nil
 		}
 	}
@@ -239,15 +628,222 @@ func (rt *RoutingTable) addPeer(p peer.ID, queryPeer bool, isReplaceable bool) (
 	if rt.df != nil {
 		rt.df.Remove(p)
 	}
+
+	// but keep it around so it can take the place of a peer that gets evicted from the bucket.
+	if rt.replacementCacheSize > 0 {
+		bucket.stashReplacement(&PeerInfo{
+			Id:           p,
+			LastUsefulAt: lastUsefulAt,
+			dhtId:        append(ID(nil), dhtId...),
+			replaceable:  isReplaceable,
+		}, rt.replacementCacheSize)
+	}
 	return false, ErrPeerRejectedNoCapacity
 }
 
+// replacePeer evicts the old peer from the given bucket to make place for the new one.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) replacePeer(b *bucket, old *PeerInfo, pi *PeerInfo) bool {
+	// the new peer goes in first so that evicting the old one can't collapse the bucket.
+	b.pushFront(pi)
+	if rt.removePeerWithDhtId(old.Id, old.dhtId) {
+		atomic.AddUint64(&rt.counters.replaced, 1)
+		rt.offerToBackup(*old)
+		rt.peerAdded(pi.Id, pi.dhtId, old)
+		return true
+	}
+	b.remove(pi.Id)
+	return false
+}
+
+// slowerPeer returns the replaceable peer with the highest latency in the given bucket if its latency exceeds
+// the given one by at least the margin configured with WithLatencyBiasedReplacement. It returns nil if
+// there is no such peer, if latency biased replacement is disabled or if the given latency is unknown.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) slowerPeer(b *bucket, latency time.Duration) *PeerInfo {
+	if !rt.latencyBiasedReplacement || latency <= 0 {
+		return nil
+	}
+
+	var slowest *PeerInfo
+	var slowestLatency time.Duration
+	for e := b.list.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*PeerInfo)
+		if !p.replaceable {
+			continue
+		}
+		if l := rt.metrics.LatencyEWMA(p.Id); slowest == nil || l > slowestLatency {
+			slowest, slowestLatency = p, l
+		}
+	}
+	if slowest == nil || slowestLatency-latency < rt.latencyMargin {
+		return nil
+	}
+	return slowest
+}
+
+// promoteReplacement fills the free slots of the bucket the given DHT ID belongs to with the
+// most recently seen replacement candidates of that bucket that are still acceptable.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) promoteReplacement(dhtId ID) {
+	bucketID := rt.bucketIdForDhtId(dhtId)
+	b := rt.buckets[bucketID]
+	for rt.occupied(bucketID) < rt.bucketsize {
+		pi := b.popReplacement()
+		if pi == nil {
+			return
+		}
+		if _, ok := rt.admissionLatency(pi.Id); b.getPeer(pi.Id) != nil || !ok {
+			continue
+		}
+		if rt.df != nil && !rt.df.TryAdd(pi.Id) {
+			continue
+		}
+
+		now := time.Now()
+		pi.LastSuccessfulOutboundQueryAt = now
+		pi.AddedAt = now
+		if err := rt.pushNewPeer(b, true, pi); err != nil {
+			if rt.df != nil {
+				rt.df.Remove(pi.Id)
+			}
+			return
+		}
+	}
+}
+
+// ReplacementCache returns the replacement candidates of all buckets, most recently seen first within
+// each bucket. The cache is only populated if the table was created with WithReplacementCacheSize.
+func (rt *RoutingTable) ReplacementCache() []peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var ps []peer.ID
+	for _, b := range rt.buckets {
+		ps = append(ps, b.replacementIds()...)
+	}
+	return ps
+}
+
+// pushNewPeer adds a new peer to the given bucket, making sure the Routing Table doesn't
+// grow beyond its maximum size. If the table is full, the peer is rejected with ErrTableFull
+// unless evict is true and the table is configured to evict another peer to make room for it.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) pushNewPeer(b *bucket, evict bool, pi *PeerInfo) error {
+	var victim *PeerInfo
+	if rt.maxTableSize > 0 && rt.tableLoad() >= rt.maxTableSize {
+		if !evict || rt.tableFullPolicy == RejectWhenFull {
+			return ErrTableFull
+		}
+
+		// push the peer first so that evicting a peer can't collapse the bucket it belongs to.
+		b.pushFront(pi)
+		if rt.tableFullPolicy == EvictByScoreWhenFull {
+			victim = rt.highestScoringPeer(pi.Id)
+		} else {
+			victim = rt.stalestPeer(pi.Id)
+		}
+		if victim == nil || !rt.removePeerWithDhtId(victim.Id, victim.dhtId) {
+			b.remove(pi.Id)
+			return ErrTableFull
+		}
+		atomic.AddUint64(&rt.counters.replaced, 1)
+		rt.offerToBackup(*victim)
+	} else {
+		b.pushFront(pi)
+	}
+
+	rt.peerAdded(pi.Id, pi.dhtId, victim)
+	return nil
+}
+
+// peerAdded fires the notifications for a peer that was just added to the Routing Table, in place of the
+// given peer if it replaced one, which must already have been removed.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) peerAdded(p peer.ID, dhtId ID, replaced *PeerInfo) {
+	atomic.AddUint64(&rt.counters.added, 1)
+
+	// a peer in the table is no longer a candidate to replace one.
+	if rt.replacementCacheSize > 0 {
+		removeFromList(rt.buckets[rt.bucketIdForDhtId(dhtId)].replacements, p)
+	}
+
+	rt.closestAdded(p, dhtId)
+	rt.subscribers.publish(PeerAddedChange, p)
+
+	peerAdded := rt.PeerAdded
+	rt.queueNotification(func() {
+		if peerAdded != nil {
+			peerAdded(p)
+		}
+		rt.addedListeners.notify(p)
+	})
+	if rt.debouncer != nil {
+		rt.debouncer.peerAdded(p)
+	}
+
+	// the Cpl was already populated if the peer is not the only one with it, or if the peer it replaced had it too.
+	cpl := uint(CommonPrefixLen(dhtId, rt.local))
+	if rt.CplPopulated != nil && rt.nPeersForCpl(cpl) == 1 && (replaced == nil || CommonPrefixLen(replaced.dhtId, rt.local) != int(cpl)) {
+		cplPopulated := rt.CplPopulated
+		rt.queueNotification(func() { cplPopulated(cpl) })
+	}
+}
+
+// stalestPeer returns the replaceable peer with the oldest LastSuccessfulOutboundQueryAt in the Routing Table,
+// ignoring the given peer. It returns nil if there is no such peer.
+// the caller is responsible for the locking
+func (rt *RoutingTable) stalestPeer(except peer.ID) *PeerInfo {
+	var stalest *PeerInfo
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			if p.Id == except || !p.replaceable {
+				continue
+			}
+			if stalest == nil || p.LastSuccessfulOutboundQueryAt.Before(stalest.LastSuccessfulOutboundQueryAt) {
+				stalest = p
+			}
+		}
+	}
+	return stalest
+}
+
+// highestScoringPeer returns the replaceable peer with the highest eviction score in the Routing Table, as
+// weighed by the CompositeEvictionWeights, ignoring the given peer. It returns nil if there is no such peer.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) highestScoringPeer(except peer.ID) *PeerInfo {
+	var (
+		highest      *PeerInfo
+		highestScore float64
+	)
+	now := time.Now()
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			if p.Id == except || !p.replaceable {
+				continue
+			}
+			score := rt.evictionWeights.Staleness*now.Sub(p.LastSuccessfulOutboundQueryAt).Seconds() +
+				rt.evictionWeights.Latency*float64(rt.metrics.LatencyEWMA(p.Id))/float64(time.Millisecond)
+			if highest == nil || score > highestScore {
+				highest, highestScore = p, score
+			}
+		}
+	}
+	return highest
+}
+
 // MarkAllPeersIrreplaceable marks all peers in the routing table as irreplaceable
 // This means that we will never replace an existing peer in the table to make space for a new peer.
 // However, they can still be removed by calling the `RemovePeer` API.
 func (rt *RoutingTable) MarkAllPeersIrreplaceable() {
-	rt.tabLock.Lock()
-	defer rt.tabLock.Unlock()
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return
+	}
 
 	for i := range rt.buckets {
 		b := rt.buckets[i]
@@ -259,7 +855,7 @@ func (rt *RoutingTable) MarkAllPeersIrreplaceable() {
 
 // GetPeerInfos returns the peer information that we've stored in the buckets
 func (rt *RoutingTable) GetPeerInfos() []PeerInfo {
-	rt.tabLock.RLock()
+	rt.rlockTable()
 	defer rt.tabLock.RUnlock()
 
 	var pis []PeerInfo
@@ -269,17 +865,101 @@ func (rt *RoutingTable) GetPeerInfos() []PeerInfo {
 	return pis
 }
 
+// PeersPage returns the peer information of at most limit peers, starting at the given offset, along with
+// the number of peers in the Routing Table. Peers are ordered by bucket index, then by their position in
+// their bucket, which is the order GetPeerInfos uses, so that successive pages are consistent as long as
+// the table isn't modified in between. An offset past the end returns no peers.
+func (rt *RoutingTable) PeersPage(offset, limit int) ([]PeerInfo, int) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	total := rt.size()
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || offset >= total {
+		return nil, total
+	}
+	if limit > total-offset {
+		limit = total - offset
+	}
+
+	pis := make([]PeerInfo, 0, limit)
+	for _, b := range rt.buckets {
+		// skip whole buckets until we reach the offset.
+		if offset >= b.len() {
+			offset -= b.len()
+			continue
+		}
+		for e := b.list.Front(); e != nil && len(pis) < limit; e = e.Next() {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			pis = append(pis, *e.Value.(*PeerInfo))
+		}
+		if len(pis) == limit {
+			break
+		}
+	}
+	return pis, total
+}
+
+// PeersByStaleness returns the peer information of all peers in the Routing Table, ordered by
+// LastSuccessfulOutboundQueryAt from the oldest to the most recent, i.e. most stale first.
+func (rt *RoutingTable) PeersByStaleness() []PeerInfo {
+	pis := rt.GetPeerInfos()
+	sort.SliceStable(pis, func(i, j int) bool {
+		return pis[i].LastSuccessfulOutboundQueryAt.Before(pis[j].LastSuccessfulOutboundQueryAt)
+	})
+	return pis
+}
+
+// PeersByAge returns the peer information of all peers in the Routing Table, ordered by AddedAt
+// from the oldest to the most recent, i.e. longest-standing first.
+func (rt *RoutingTable) PeersByAge() []PeerInfo {
+	pis := rt.GetPeerInfos()
+	sort.SliceStable(pis, func(i, j int) bool {
+		return pis[i].AddedAt.Before(pis[j].AddedAt)
+	})
+	return pis
+}
+
+// OldestPeer returns the peer information of the peer that has been in the Routing Table the longest,
+// by AddedAt. It returns false if the table is empty.
+func (rt *RoutingTable) OldestPeer() (PeerInfo, bool) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var oldest *PeerInfo
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			if p := e.Value.(*PeerInfo); oldest == nil || p.AddedAt.Before(oldest.AddedAt) {
+				oldest = p
+			}
+		}
+	}
+	if oldest == nil {
+		return PeerInfo{}, false
+	}
+	return *oldest, true
+}
+
 // UpdateLastSuccessfulOutboundQueryAt updates the LastSuccessfulOutboundQueryAt time of the peer.
 // Returns true if the update was successful, false otherwise.
 func (rt *RoutingTable) UpdateLastSuccessfulOutboundQueryAt(p peer.ID, t time.Time) bool {
-	rt.tabLock.Lock()
-	defer rt.tabLock.Unlock()
+	rt.lockTable()
+	defer rt.unlockTable()
 
+	if rt.closed {
+		return false
+	}
 	bucketID := rt.bucketIdForPeer(p)
 	bucket := rt.buckets[bucketID]
 
 	if pc := bucket.getPeer(p); pc != nil {
 		pc.LastSuccessfulOutboundQueryAt = t
+		rt.subscribers.publish(PeerUpdatedChange, p)
 		return true
 	}
 	return false
@@ -288,14 +968,38 @@ func (rt *RoutingTable) UpdateLastSuccessfulOutboundQueryAt(p peer.ID, t time.Ti
 // UpdateLastUsefulAt updates the LastUsefulAt time of the peer.
 // Returns true if the update was successful, false otherwise.
 func (rt *RoutingTable) UpdateLastUsefulAt(p peer.ID, t time.Time) bool {
-	rt.tabLock.Lock()
-	defer rt.tabLock.Unlock()
+	rt.lockTable()
+	defer rt.unlockTable()
 
+	if rt.closed {
+		return false
+	}
 	bucketID := rt.bucketIdForPeer(p)
 	bucket := rt.buckets[bucketID]
 
 	if pc := bucket.getPeer(p); pc != nil {
 		pc.LastUsefulAt = t
+		rt.subscribers.publish(PeerUpdatedChange, p)
+		return true
+	}
+	return false
+}
+
+// MarkPeerUseful records that the peer was just useful to us by setting both its LastUsefulAt and its
+// LastSuccessfulOutboundQueryAt times to now, so that it's no longer considered stale, e.g. by
+// EvictStalestWhenFull or PeersByStaleness. Returns true if the peer is in the Routing Table, false otherwise.
+func (rt *RoutingTable) MarkPeerUseful(p peer.ID) bool {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return false
+	}
+	if pc := rt.buckets[rt.bucketIdForPeer(p)].getPeer(p); pc != nil {
+		now := time.Now()
+		pc.LastUsefulAt = now
+		pc.LastSuccessfulOutboundQueryAt = now
+		rt.subscribers.publish(PeerUpdatedChange, p)
 		return true
 	}
 	return false
@@ -303,60 +1007,375 @@ func (rt *RoutingTable) UpdateLastUsefulAt(p peer.ID, t time.Time) bool {
 
 // RemovePeer should be called when the caller is sure that a peer is not useful for queries.
 // For eg: the peer could have stopped supporting the DHT protocol.
-// It evicts the peer from the Routing Table.
+// It evicts the peer from the Routing Table, promoting a replacement candidate in its place if there is one,
+// unless CanRemovePeer vetoes it.
 func (rt *RoutingTable) RemovePeer(p peer.ID) {
-	rt.tabLock.Lock()
-	defer rt.tabLock.Unlock()
-	rt.removePeer(p)
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	dhtId := ConvertPeerID(p)
+	if rt.removePeerWithDhtId(p, dhtId) {
+		rt.promoteReplacement(dhtId)
+	}
 }
 
-// locking is the responsibility of the caller
-func (rt *RoutingTable) removePeer(p peer.ID) bool {
-	bucketID := rt.bucketIdForPeer(p)
-	bucket := rt.buckets[bucketID]
-	if bucket.remove(p) {
-		if rt.df != nil {
-			rt.df.Remove(p)
+// DropInvalidPeers removes the peers of the Routing Table whose DHT ID is the local ID, i.e. that are at
+// distance zero from us, as RemovePeer would, and returns them. Such a peer is normally ourselves, which
+// has no business being in our own table.
+func (rt *RoutingTable) DropInvalidPeers() []peer.ID {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	// the peers with our ID are in the last bucket, as they share all bits with us.
+	var dropped []peer.ID
+	for _, p := range rt.buckets[len(rt.buckets)-1].peers() {
+		if !bytes.Equal(p.dhtId, rt.local) {
+			continue
 		}
-		for {
-			lastBucketIndex := len(rt.buckets) - 1
-
-			// remove the last bucket if it's empty and it isn't the only bucket we have
-			if len(rt.buckets) > 1 && rt.buckets[lastBucketIndex].len() == 0 {
-				rt.buckets[lastBucketIndex] = nil
-				rt.buckets = rt.buckets[:lastBucketIndex]
-			} else if len(rt.buckets) >= 2 && rt.buckets[lastBucketIndex-1].len() == 0 {
-				// if the second last bucket just became empty, remove and replace it with the last bucket.
-				rt.buckets[lastBucketIndex-1] = rt.buckets[lastBucketIndex]
-				rt.buckets[lastBucketIndex] = nil
-				rt.buckets = rt.buckets[:lastBucketIndex]
-			} else {
-				break
-			}
+		if rt.removePeerWithDhtId(p.Id, p.dhtId) {
+			rt.promoteReplacement(p.dhtId)
+			dropped = append(dropped, p.Id)
 		}
+	}
+	return dropped
+}
+
+// RemoveStalePeers evicts all peers whose LastSuccessfulOutboundQueryAt is older than the given duration,
+// regardless of whether their bucket is full, promoting replacement candidates in their place.
+// It returns the peers it removed.
+func (rt *RoutingTable) RemoveStalePeers(olderThan time.Duration) []peer.ID {
+	removed, _ := rt.removeStalePeers(func(int) time.Duration { return olderThan }, nil)
+	return removed
+}
+
+// EnforceDiversity runs all peers in the Routing Table through the diversity filter again, e.g. after their
+// addresses changed, and evicts the ones the filter no longer admits, promoting replacement candidates in their
+// place. Peers are re-evaluated from the longest-standing to the most recently added, with the peers protected
+// by CanRemovePeer first, so that they get the quota first. A protected peer the filter rejects is kept anyway,
+// and still counts towards the quota of its groups.
+// It returns the peers it removed, which is always empty without a diversity filter.
+func (rt *RoutingTable) EnforceDiversity() []peer.ID {
+	if rt.df == nil {
+		return nil
+	}
+
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	// resetting the filter of a closed table would leave it out of sync with its peers.
+	if rt.closed {
+		return nil
+	}
+	var pis []PeerInfo
+	for _, b := range rt.buckets {
+		pis = append(pis, b.peers()...)
+	}
+	protected := make(map[peer.ID]bool)
+	if rt.CanRemovePeer != nil {
+		for _, pi := range pis {
+			protected[pi.Id] = !rt.CanRemovePeer(pi.Id)
+		}
+	}
+	sort.SliceStable(pis, func(i, j int) bool {
+		if protected[pis[i].Id] != protected[pis[j].Id] {
+			return protected[pis[i].Id]
+		}
+		return pis[i].AddedAt.Before(pis[j].AddedAt)
+	})
+
+	// start over from an empty filter, as if the peers were added one by one.
+	for _, pi := range pis {
+		rt.df.Remove(pi.Id)
+	}
+	var evicted []PeerInfo
+	for _, pi := range pis {
+		if protected[pi.Id] {
+			rt.df.Add(pi.Id)
+		} else if !rt.df.TryAdd(pi.Id) {
+			evicted = append(evicted, pi)
+		}
+	}
+
+	removed := make([]peer.ID, 0, len(evicted))
+	for _, pi := range evicted {
+		if rt.removePeerWithDhtId(pi.Id, pi.dhtId) {
+			removed = append(removed, pi.Id)
+		}
+	}
+	// only promote once all peers have been re-evaluated, so that replacements don't take their quota.
+	for _, pi := range evicted {
+		rt.promoteReplacement(pi.dhtId)
+	}
+	return removed
+}
+
+// removeStalePeers is RemoveStalePeers with a duration per bucket index, sparing the stale peers for which
+// veto returns true. A nil veto spares nobody. It also returns how many peers were checked.
+func (rt *RoutingTable) removeStalePeers(olderThan func(bucketIndex int) time.Duration, veto func(peer.ID) bool) ([]peer.ID, int) {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	var stale []PeerInfo
+	checked := 0
+	for i, b := range rt.buckets {
+		maxAge := olderThan(i)
+		for _, p := range b.peers() {
+			checked++
+			if time.Since(p.LastSuccessfulOutboundQueryAt) > maxAge && (veto == nil || !veto(p.Id)) {
+				stale = append(stale, p)
+			}
+		}
+	}
+
+	removed := make([]peer.ID, 0, len(stale))
+	for _, p := range stale {
+		if rt.removePeerWithDhtId(p.Id, p.dhtId) {
+			rt.offerToBackup(p)
+			rt.promoteReplacement(p.dhtId)
+			removed = append(removed, p.Id)
+		}
+	}
+	return removed, checked
+}
+
+// removePeerWithDhtId removes the peer given its already hashed DHT ID.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) removePeerWithDhtId(p peer.ID, dhtId ID) bool {
+	if rt.closed {
+		return false
+	}
+	bucketID := rt.bucketIdForDhtId(dhtId)
+	bucket := rt.buckets[bucketID]
+	if rt.CanRemovePeer != nil && bucket.getPeer(p) != nil && !rt.CanRemovePeer(p) {
+		return false
+	}
+	if bucket.remove(p) {
+		if rt.df != nil {
+			rt.df.Remove(p)
+		}
+		rt.collapseBuckets()
+		atomic.AddUint64(&rt.counters.removed, 1)
+
+		rt.notifyRoom()
+
+		rt.closestRemoved(p)
+		rt.subscribers.publish(PeerRemovedChange, p)
 
 		// peer removed callback
-		rt.PeerRemoved(p)
+		peerRemoved := rt.PeerRemoved
+		rt.queueNotification(func() {
+			if peerRemoved != nil {
+				peerRemoved(p)
+			}
+			rt.removedListeners.notify(p)
+		})
+		if rt.debouncer != nil {
+			rt.debouncer.peerRemoved(p)
+		}
 		return true
 	}
 	return false
 }
 
+// collapseBuckets removes empty buckets from the end of the table.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) collapseBuckets() {
+	for {
+		lastBucketIndex := len(rt.buckets) - 1
+
+		// remove the last bucket if it's empty and it isn't the only bucket we have
+		// the replacement candidates of the removed bucket now belong to the new last bucket.
+		if len(rt.buckets) > 1 && rt.buckets[lastBucketIndex].len() == 0 {
+			rt.buckets[lastBucketIndex-1].mergeReplacements(rt.buckets[lastBucketIndex], rt.replacementCacheSize)
+			rt.buckets[lastBucketIndex] = nil
+			rt.buckets = rt.buckets[:lastBucketIndex]
+		} else if len(rt.buckets) >= 2 && rt.buckets[lastBucketIndex-1].len() == 0 {
+			// if the second last bucket just became empty, remove and replace it with the last bucket.
+			rt.buckets[lastBucketIndex].mergeReplacements(rt.buckets[lastBucketIndex-1], rt.replacementCacheSize)
+			rt.buckets[lastBucketIndex-1] = rt.buckets[lastBucketIndex]
+			rt.buckets[lastBucketIndex] = nil
+			rt.buckets = rt.buckets[:lastBucketIndex]
+		} else {
+			break
+		}
+	}
+}
+
+// Rebalance recomputes the bucket placement of all peers in the Routing Table given its current
+// configuration, splitting or merging buckets as needed. Peers keep all of their metadata.
+// It is a no-op if the structure of the table is already consistent.
+//
+// Peers are never evicted by a rebalance, so a dedicated bucket can still hold more peers than the
+// bucket size after it. Such a bucket won't accept new peers until enough of them have been removed.
+func (rt *RoutingTable) Rebalance() {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed || rt.checkInvariants() == nil {
+		return
+	}
+
+	// fold all peers back into a single wildcard bucket...
+	all := newBucket()
+	for _, b := range rt.buckets {
+		all.list.PushBackList(b.list)
+		all.replacements.PushBackList(b.replacements)
+	}
+	rt.buckets = []*bucket{all}
+
+	// ...and unfold it for as long as the last bucket overflows.
+	for rt.buckets[len(rt.buckets)-1].len() > rt.bucketsize && len(rt.buckets) < rt.maxBuckets() {
+		last := rt.buckets[len(rt.buckets)-1]
+		rt.buckets = append(rt.buckets, last.split(len(rt.buckets)-1, rt.local))
+	}
+	if len(rt.buckets) > rt.maxDepthReached {
+		rt.maxDepthReached = len(rt.buckets)
+	}
+	rt.collapseBuckets()
+	for _, b := range rt.buckets {
+		b.trimReplacements(rt.replacementCacheSize)
+	}
+}
+
+// CheckInvariants reports an error describing the first structural inconsistency found in the
+// Routing Table, such as a peer present more than once or placed in the wrong bucket, if any.
+func (rt *RoutingTable) CheckInvariants() error {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+	return rt.checkInvariants()
+}
+
+// checkInvariants verifies that every peer is in the bucket it belongs to, that no peer is in the
+// table more than once and that no bucket holds more peers than the bucket size.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) checkInvariants() error {
+	seen := make(map[peer.ID]struct{})
+	for i, b := range rt.buckets {
+		if b.len() > rt.bucketsize {
+			return fmt.Errorf("bucket %d holds %d peers, more than the bucket size %d", i, b.len(), rt.bucketsize)
+		}
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			if _, ok := seen[p.Id]; ok {
+				return fmt.Errorf("peer %s is in the table more than once", p.Id)
+			}
+			seen[p.Id] = struct{}{}
+
+			if !bytes.Equal(p.dhtId, ConvertPeerID(p.Id)) {
+				return fmt.Errorf("peer %s has a mismatched DHT ID", p.Id)
+			}
+			if id := rt.bucketIdForDhtId(p.dhtId); id != i {
+				return fmt.Errorf("peer %s is in bucket %d but belongs in bucket %d", p.Id, i, id)
+			}
+		}
+	}
+	return nil
+}
+
 func (rt *RoutingTable) nextBucket() {
+	// Unfold the table until the last bucket is not overflowing, or until we've reached the limit set with
+	// WithMaxBucketUnfolds, so that a single call doesn't hold the lock for too many splits.
+	for unfolds := 0; rt.maxUnfolds == 0 || unfolds < rt.maxUnfolds; unfolds++ {
+		// There can't be more buckets than there are possible Cpls with the local ID.
+		if len(rt.buckets) >= rt.maxBuckets() {
+			log.Warnf("not splitting the last bucket, the table already has the maximum of %d buckets", len(rt.buckets))
+			return
+		}
+
+		// The newly formed bucket still contains too many peers if we just unfolded an empty bucket.
+		if newBucket := rt.splitLastBucket(); newBucket.len() < rt.bucketsize {
+			return
+		}
+	}
+}
+
+// splitLastBucket unfolds the last bucket, moving the peers that don't have the Cpl of its index to a new
+// last bucket, which it returns.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) splitLastBucket() *bucket {
 	// This is the last bucket, which allegedly is a mixed bag containing peers not belonging in dedicated (unfolded) buckets.
 	// _allegedly_ is used here to denote that *all* peers in the last bucket might feasibly belong to another bucket.
 	// This could happen if e.g. we've unfolded 4 buckets, and all peers in folded bucket 5 really belong in bucket 8.
 	bucket := rt.buckets[len(rt.buckets)-1]
 	newBucket := bucket.split(len(rt.buckets)-1, rt.local)
 	rt.buckets = append(rt.buckets, newBucket)
+	rt.recordSplit(SplitEvent{At: time.Now(), Bucket: len(rt.buckets) - 1})
+	if len(rt.buckets) > rt.maxDepthReached {
+		rt.maxDepthReached = len(rt.buckets)
+	}
+	return newBucket
+}
 
-	// The newly formed bucket still contains too many peers. We probably just unfolded a empty bucket.
-	if newBucket.len() >= rt.bucketsize {
-		// Keep unfolding the table until the last bucket is not overflowing.
-		rt.nextBucket()
+// SplitToCpl unfolds the Routing Table until the given Cpl has a dedicated bucket, see HasBucketForCpl,
+// however few peers the buckets hold, creating empty buckets as needed. It does nothing if the Cpl already
+// has a dedicated bucket, and it unfolds the table fully if the Cpl is beyond what the local ID allows.
+// Like any empty bucket at the end of the table, the buckets that are still empty when a peer is removed are
+// collapsed.
+func (rt *RoutingTable) SplitToCpl(cpl uint) {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return
+	}
+	for int(cpl) >= len(rt.buckets)-1 && len(rt.buckets) < rt.maxBuckets() {
+		rt.splitLastBucket()
 	}
 }
 
+// maxBuckets returns the number of buckets of a fully unfolded table, one per possible Cpl with the local ID.
+func (rt *RoutingTable) maxBuckets() int {
+	return len(rt.local)*8 + 1
+}
+
+// KeyspaceCoverage estimates how much of the keyspace the Routing Table can route towards, from 0 to 1.
+// Each bucket holds the peers towards one region of the keyspace, the keys sharing a given Cpl with us, so the
+// estimate is the number of non-empty buckets divided by the largest number of buckets the table ever had,
+// see MaxDepthReached. It doesn't weigh the regions by their size, nor the buckets by how full they are.
+func (rt *RoutingTable) KeyspaceCoverage() float64 {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	nonEmpty := 0
+	for _, b := range rt.buckets {
+		if b.len() > 0 {
+			nonEmpty++
+		}
+	}
+	return float64(nonEmpty) / float64(rt.maxDepthReached)
+}
+
+// locking is the responsibility of the caller
+func (rt *RoutingTable) recordSplit(ev SplitEvent) {
+	if len(rt.splitHistory) < splitHistorySize {
+		rt.splitHistory = append(rt.splitHistory, ev)
+		return
+	}
+	rt.splitHistory[rt.splitHistoryNext] = ev
+	rt.splitHistoryNext = (rt.splitHistoryNext + 1) % splitHistorySize
+}
+
+// MaxDepthReached returns the largest number of buckets the Routing Table ever had, even if empty buckets
+// have since been collapsed.
+func (rt *RoutingTable) MaxDepthReached() int {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	return rt.maxDepthReached
+}
+
+// SplitHistory returns the most recent bucket splits of the Routing Table, oldest first.
+// Only the last 128 splits are remembered.
+// Caller is free to modify the returned slice as it is a defensive copy.
+func (rt *RoutingTable) SplitHistory() []SplitEvent {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	out := make([]SplitEvent, 0, len(rt.splitHistory))
+	out = append(out, rt.splitHistory[rt.splitHistoryNext:]...)
+	return append(out, rt.splitHistory[:rt.splitHistoryNext]...)
+}
+
 // Find a specific peer by ID or return nil
 func (rt *RoutingTable) Find(id peer.ID) peer.ID {
 	srch := rt.NearestPeers(ConvertPeerID(id), 1)
@@ -377,29 +1396,103 @@ func (rt *RoutingTable) NearestPeer(id ID) peer.ID {
 	return ""
 }
 
+// nearestPeersHeapMaxCount is the largest count for which NearestPeers selects the closest
+// peers with a bounded heap instead of sorting every candidate it collects.
+const nearestPeersHeapMaxCount = 32
+
 // NearestPeers returns a list of the 'count' closest peers to the given ID
 func (rt *RoutingTable) NearestPeers(id ID, count int) []peer.ID {
+	return rt.nearestPeers(id, count, count <= nearestPeersHeapMaxCount, nil)
+}
+
+// NearestPeersExcluding returns a list of the 'count' closest peers to the given ID that aren't in the
+// excluded set, looking further away in the table for as long as it takes to find them.
+func (rt *RoutingTable) NearestPeersExcluding(id ID, count int, exclude map[peer.ID]struct{}) []peer.ID {
+	var keep func(*PeerInfo) bool
+	if len(exclude) > 0 {
+		keep = func(p *PeerInfo) bool {
+			_, excluded := exclude[p.Id]
+			return !excluded
+		}
+	}
+	return rt.nearestPeers(id, count, count <= nearestPeersHeapMaxCount, keep)
+}
+
+// NearestPeersSupporting returns a list of the 'count' closest peers to the given ID for which supports
+// returns true, e.g. the peers speaking the protocol a lookup needs. Peers are filtered before they are
+// counted, so the table is searched further away for as long as it takes to find enough supporting peers.
+// supports is called with the table's read lock held, so it must not call into the table.
+func (rt *RoutingTable) NearestPeersSupporting(id ID, count int, supports func(peer.ID) bool) []peer.ID {
+	return rt.nearestPeers(id, count, count <= nearestPeersHeapMaxCount, func(p *PeerInfo) bool {
+		return supports(p.Id)
+	})
+}
+
+// nearestPeers returns the 'count' closest peers to the given ID among the ones keep returns true for,
+// or among all peers if keep is nil.
+func (rt *RoutingTable) nearestPeers(id ID, count int, useHeap bool, keep func(*PeerInfo) bool) []peer.ID {
+	var pds []peerDistance
+	if useHeap {
+		pdh := peerDistanceHeap{
+			peers:  make([]peerDistance, 0, count),
+			target: id,
+			count:  count,
+			keep:   keep,
+		}
+		rt.rlockTable()
+		rt.collectNearest(&pdh, id, count)
+		rt.tabLock.RUnlock()
+
+		pds = pdh.sorted()
+	} else {
+		pdsr := peerDistanceSorter{
+			peers:  make([]peerDistance, 0, count+rt.bucketsize),
+			target: id,
+			keep:   keep,
+		}
+		rt.rlockTable()
+		rt.collectNearest(&pdsr, id, count)
+		rt.tabLock.RUnlock()
+
+		// Sort by distance to local peer
+		pdsr.sort()
+		pds = pdsr.peers
+	}
+
+	if count < len(pds) {
+		pds = pds[:count]
+	}
+
+	out := make([]peer.ID, 0, len(pds))
+	for _, p := range pds {
+		out = append(out, p.p)
+	}
+
+	return out
+}
+
+// collectNearest adds the peers from the buckets closest to the given ID to the collector
+// until it holds at least 'count' peers or we run out of buckets.
+// the caller is responsible for the locking
+func (rt *RoutingTable) collectNearest(pc peerCollector, id ID, count int) {
+	collectNearestFrom(rt.buckets, rt.local, pc, id, count)
+}
+
+// collectNearestFrom is collectNearest for the given buckets of the table of the given local ID.
+func collectNearestFrom(buckets []*bucket, local ID, pc peerCollector, id ID, count int) {
 	// This is the number of bits _we_ share with the key. All peers in this
 	// bucket share cpl bits with us and will therefore share at least cpl+1
 	// bits with the given key. +1 because both the target and all peers in
 	// this bucket differ from us in the cpl bit.
-	cpl := CommonPrefixLen(id, rt.local)
-
-	// It's assumed that this also protects the buckets.
-	rt.tabLock.RLock()
+	cpl := CommonPrefixLen(id, local)
 
 	// Get bucket index or last bucket
-	if cpl >= len(rt.buckets) {
-		cpl = len(rt.buckets) - 1
-	}
-
-	pds := peerDistanceSorter{
-		peers:  make([]peerDistance, 0, count+rt.bucketsize),
-		target: id,
+	if cpl >= len(buckets) {
+		cpl = len(buckets) - 1
 	}
 
 	// Add peers from the target bucket (cpl+1 shared bits).
-	pds.appendPeersFromList(rt.buckets[cpl].list)
+	pc.appendPeersFromList(buckets[cpl].list)
 
 	// If we're short, add peers from all buckets to the right. All buckets
 	// to the right share exactly cpl bits (as opposed to the cpl+1 bits
@@ -409,9 +1502,9 @@ func (rt *RoutingTable) NearestPeers(id ID, count int) []peer.ID {
 	// to a trie implementation eventually which will allow us to find the
 	// closest N peers to any target key.
 
-	if pds.Len() < count {
-		for i := cpl + 1; i < len(rt.buckets); i++ {
-			pds.appendPeersFromList(rt.buckets[i].list)
+	if pc.Len() < count {
+		for i := cpl + 1; i < len(buckets); i++ {
+			pc.appendPeersFromList(buckets[i].list)
 		}
 	}
 
@@ -422,40 +1515,210 @@ func (rt *RoutingTable) NearestPeers(id ID, count int) []peer.ID {
 	// * bucket cpl-1: cpl-1 shared bits.
 	// * bucket cpl-2: cpl-2 shared bits.
 	// ...
-	for i := cpl - 1; i >= 0 && pds.Len() < count; i-- {
-		pds.appendPeersFromList(rt.buckets[i].list)
+	for i := cpl - 1; i >= 0 && pc.Len() < count; i-- {
+		pc.appendPeersFromList(buckets[i].list)
 	}
-	rt.tabLock.RUnlock()
+}
 
-	// Sort by distance to local peer
-	pds.sort()
+// PeersWithPrefix returns all peers in the routing table whose DHT ID starts with the first
+// 'prefixBits' bits of the given prefix, in no particular order.
+func (rt *RoutingTable) PeersWithPrefix(prefix []byte, prefixBits int) []peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
 
-	if count < pds.Len() {
-		pds.peers = pds.peers[:count]
+	var peers []peer.ID
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			if p := e.Value.(*PeerInfo); hasBitPrefix(p.dhtId, prefix, prefixBits) {
+				peers = append(peers, p.Id)
+			}
+		}
 	}
+	return peers
+}
+
+// PeersByRealCpl returns all peers in the routing table grouped by their actual Cpl with the local ID.
+// Unlike the bucket index of a peer, this tells apart the peers of the last bucket, which holds all Cpls
+// that don't have a dedicated bucket yet. Cpls without peers are absent from the map.
+func (rt *RoutingTable) PeersByRealCpl() map[uint][]peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	byCpl := make(map[uint][]peer.ID)
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			cpl := uint(CommonPrefixLen(rt.local, p.dhtId))
+			byCpl[cpl] = append(byCpl[cpl], p.Id)
+		}
+	}
+	return byCpl
+}
+
+// MaxPairwiseCpl returns the two peers in the routing table whose DHT IDs share the longest common prefix
+// with each other, along with its length. An unusually long one can reveal IDs crafted to cluster around
+// a region of the keyspace. It returns empty peer IDs and a zero Cpl if the table has fewer than two peers.
+func (rt *RoutingTable) MaxPairwiseCpl() (a, b peer.ID, cpl int) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var pis []*PeerInfo
+	for _, buck := range rt.buckets {
+		for e := buck.list.Front(); e != nil; e = e.Next() {
+			pis = append(pis, e.Value.(*PeerInfo))
+		}
+	}
+
+	// once the IDs are sorted, the longest common prefix is shared by two neighbours.
+	sort.Slice(pis, func(i, j int) bool {
+		return bytes.Compare(pis[i].dhtId, pis[j].dhtId) < 0
+	})
+	cpl = -1
+	for i := 1; i < len(pis); i++ {
+		if c := CommonPrefixLen(pis[i-1].dhtId, pis[i].dhtId); c > cpl {
+			a, b, cpl = pis[i-1].Id, pis[i].Id, c
+		}
+	}
+	if cpl < 0 {
+		return "", "", 0
+	}
+	return a, b, cpl
+}
+
+// PeerDistance returns the xor distance between two peers, see Distance. The peers are converted to DHT IDs with
+// ConvertPeerID, like all the peers of the Routing Table; they don't need to be in the table.
+func (rt *RoutingTable) PeerDistance(a, b peer.ID) *big.Int {
+	return Distance(ConvertPeerID(a), ConvertPeerID(b))
+}
+
+// PeersWithinDistance returns all peers in the routing table whose xor distance to the given key is
+// at most 'radius', ordered by ascending distance from the key.
+func (rt *RoutingTable) PeersWithinDistance(key ID, radius *big.Int) []peer.ID {
+	pds := peerDistanceSorter{
+		target: key,
+	}
+
+	rt.rlockTable()
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			if Distance(key, p.dhtId).Cmp(radius) <= 0 {
+				pds.appendPeer(p.Id, p.dhtId)
+			}
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	pds.sort()
 
 	out := make([]peer.ID, 0, pds.Len())
 	for _, p := range pds.peers {
 		out = append(out, p.p)
 	}
-
 	return out
 }
 
+// RankOf returns the number of peers in the routing table that are closer to the given key than p,
+// i.e. a rank of 0 means p is the closest peer to the key we know of.
+// It returns false if p isn't in the routing table.
+func (rt *RoutingTable) RankOf(key ID, p peer.ID) (rank int, ok bool) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	pi := rt.buckets[rt.bucketIdForPeer(p)].getPeer(p)
+	if pi == nil {
+		return 0, false
+	}
+	pDistance := xor(key, pi.dhtId)
+
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			if xor(key, e.Value.(*PeerInfo).dhtId).less(pDistance) {
+				rank++
+			}
+		}
+	}
+	return rank, true
+}
+
+// PeerRank returns the 0-based position of p among all peers in the routing table
+// sorted by ascending distance to the target. It returns false if p isn't in the routing table.
+// It is equivalent to RankOf(target, p).
+func (rt *RoutingTable) PeerRank(p peer.ID, target ID) (int, bool) {
+	return rt.RankOf(target, p)
+}
+
+// WeightedRandomPeer picks a random peer from the routing table with a probability proportional
+// to the weight the given function assigns to it. Peers with a non-positive or infinite weight are never picked.
+// It returns false if no peer has a positive weight.
+func (rt *RoutingTable) WeightedRandomPeer(weight func(PeerInfo) float64) (peer.ID, bool) {
+	rt.rlockTable()
+	var (
+		candidates []peer.ID
+		weights    []float64
+		total      float64
+	)
+	for _, b := range rt.buckets {
+		for _, p := range b.peers() {
+			w := weight(p)
+			if !(w > 0) || math.IsInf(w, 1) {
+				continue
+			}
+			candidates = append(candidates, p.Id)
+			weights = append(weights, w)
+			total += w
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	rt.rngLk.Lock()
+	r := rt.rng.Float64() * total
+	rt.rngLk.Unlock()
+
+	for i, w := range weights {
+		if r < w {
+			return candidates[i], true
+		}
+		r -= w
+	}
+	// guard against floating point rounding leaving r just above the last weight.
+	return candidates[len(candidates)-1], true
+}
+
 // Size returns the total number of peers in the routing table
 func (rt *RoutingTable) Size() int {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	return rt.size()
+}
+
+// IsReadyForLookup reports whether the Routing Table has enough peers to start a lookup: at least minPeers
+// of them, with at least one in the first bucket. The first bucket covers the half of the keyspace farthest
+// from us, so without any peer there lookups for half of all keys can't make progress.
+func (rt *RoutingTable) IsReadyForLookup(minPeers int) bool {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	return rt.buckets[0].len() > 0 && rt.size() >= minPeers
+}
+
+// the caller is responsible for the locking
+func (rt *RoutingTable) size() int {
 	var tot int
-	rt.tabLock.RLock()
 	for _, buck := range rt.buckets {
 		tot += buck.len()
 	}
-	rt.tabLock.RUnlock()
 	return tot
 }
 
 // ListPeers takes a RoutingTable and returns a list of all peers from all buckets in the table.
 func (rt *RoutingTable) ListPeers() []peer.ID {
-	rt.tabLock.RLock()
+	rt.rlockTable()
 	defer rt.tabLock.RUnlock()
 
 	var peers []peer.ID
@@ -465,10 +1728,244 @@ func (rt *RoutingTable) ListPeers() []peer.ID {
 	return peers
 }
 
+// BucketPeers returns the peers in the bucket at the given index.
+// It returns an error if there is no bucket with that index.
+func (rt *RoutingTable) BucketPeers(index int) ([]peer.ID, error) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	if index < 0 || index >= len(rt.buckets) {
+		return nil, fmt.Errorf("bucket index %d out of range, the table has %d buckets", index, len(rt.buckets))
+	}
+	return rt.buckets[index].peerIds(), nil
+}
+
+// BucketLatencies returns the average latency EWMA of the peers in each bucket of the Routing Table, indexed
+// by bucket. Peers without a latency sample are left out of the average, and a bucket without any measured
+// peer has a zero average.
+func (rt *RoutingTable) BucketLatencies() []time.Duration {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	avgs := make([]time.Duration, len(rt.buckets))
+	for i, b := range rt.buckets {
+		var (
+			total    time.Duration
+			measured int
+		)
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			if l := rt.metrics.LatencyEWMA(e.Value.(*PeerInfo).Id); l > 0 {
+				total += l
+				measured++
+			}
+		}
+		if measured > 0 {
+			avgs[i] = total / time.Duration(measured)
+		}
+	}
+	return avgs
+}
+
+// OccupiedBucketsBitmap returns a bitmap of the buckets of the Routing Table that hold at least one peer,
+// where bucket i is the bit i of the bitmap, counting from the most significant bit of the first byte.
+// The bitmap has just enough bytes for the current number of buckets. It can be parsed back with
+// ParseOccupiedBucketsBitmap.
+func (rt *RoutingTable) OccupiedBucketsBitmap() []byte {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	bitmap := make([]byte, (len(rt.buckets)+7)/8)
+	for i, b := range rt.buckets {
+		if b.len() > 0 {
+			bitmap[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bitmap
+}
+
+// ParseOccupiedBucketsBitmap returns the indices, in ascending order, of the buckets set in a bitmap
+// returned by OccupiedBucketsBitmap.
+func ParseOccupiedBucketsBitmap(bitmap []byte) []int {
+	var occupied []int
+	for i := 0; i < len(bitmap)*8; i++ {
+		if bitmap[i/8]&(0x80>>(i%8)) != 0 {
+			occupied = append(occupied, i)
+		}
+	}
+	return occupied
+}
+
+// BucketMates returns the other peers in the same bucket as the given peer, i.e. the peers it competes with
+// for a slot, or nil if the peer isn't in the Routing Table.
+func (rt *RoutingTable) BucketMates(p peer.ID) []peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	b := rt.buckets[rt.bucketIdForPeer(p)]
+	if b.getPeer(p) == nil {
+		return nil
+	}
+	mates := make([]peer.ID, 0, b.len()-1)
+	for _, id := range b.peerIds() {
+		if id != p {
+			mates = append(mates, id)
+		}
+	}
+	return mates
+}
+
+// ClearBucket removes all peers in the bucket with the given index from the Routing Table, as RemovePeer would,
+// and returns them. Peers protected by CanRemovePeer are kept. Replacement candidates are not promoted, so the
+// bucket is left empty until new peers are added to it, unless it gets collapsed with the buckets around it
+// just like when its last peer is removed with RemovePeer. It returns nil if the index is out of range.
+func (rt *RoutingTable) ClearBucket(index int) []peer.ID {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if index < 0 || index >= len(rt.buckets) {
+		return nil
+	}
+	var removed []peer.ID
+	for _, p := range rt.buckets[index].peers() {
+		if rt.removePeerWithDhtId(p.Id, p.dhtId) {
+			removed = append(removed, p.Id)
+		}
+	}
+	return removed
+}
+
+// SetResult is the outcome of SetPeers.
+type SetResult struct {
+	// Added is the number of peers of the new set that were added to the table.
+	Added int
+	// Removed is the number of peers that were removed from the table because they aren't in the new set.
+	Removed int
+	// Kept is the number of peers of the new set that were already in the table.
+	Kept int
+	// Rejected is the number of peers of the new set that couldn't be added, see TryAddPeer.
+	Rejected int
+}
+
+// SetPeers replaces the peers of the Routing Table with the given ones under a single acquisition of the table
+// lock: the peers that aren't in the new set are removed as RemovePeer would, except that replacement candidates
+// are not promoted, then the missing ones are added in the given order as non-query, replaceable peers, as
+// TryAddPeer would, except that they never evict another peer: a peer without room in its bucket or in the
+// table is rejected. The peers that are in both keep their metadata. Peers protected by CanRemovePeer are kept
+// even if they aren't in the new set, and new peers can be rejected, so the table doesn't always end up with
+// exactly the new set, but it always ends up with Added+Kept peers of it.
+func (rt *RoutingTable) SetPeers(peers []peer.ID) SetResult {
+	want := make(map[peer.ID]struct{}, len(peers))
+	ordered := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if _, ok := want[p]; !ok {
+			want[p] = struct{}{}
+			ordered = append(ordered, p)
+		}
+	}
+
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return SetResult{}
+	}
+	// removing peers can collapse buckets, so the peers to remove are collected first.
+	var unwanted []PeerInfo
+	for _, b := range rt.buckets {
+		for _, p := range b.peers() {
+			if _, ok := want[p.Id]; !ok {
+				unwanted = append(unwanted, p)
+			}
+		}
+	}
+
+	var res SetResult
+	for _, p := range unwanted {
+		if rt.removePeerWithDhtId(p.Id, p.dhtId) {
+			res.Removed++
+		}
+	}
+
+	var added []peer.ID
+	for _, p := range ordered {
+		if rt.buckets[rt.bucketIdForPeer(p)].getPeer(p) != nil {
+			res.Kept++
+			continue
+		}
+		ok, err := rt.addPeer(context.Background(), p, false, true, false)
+		rt.countRejection(err)
+		if ok {
+			added = append(added, p)
+		} else if err != nil {
+			res.Rejected++
+		}
+	}
+	// only count the peers that made it to the end.
+	for _, p := range added {
+		if rt.buckets[rt.bucketIdForPeer(p)].getPeer(p) != nil {
+			res.Added++
+		}
+	}
+	return res
+}
+
+// ConnectednessBreakdown returns how many of the peers in the Routing Table we are connected to and how many
+// we aren't, as reported by the function set with WithConnectedness, which is called once per peer.
+// Both numbers are computed from the same snapshot of the table. Without a connectedness function,
+// all peers count as disconnected.
+func (rt *RoutingTable) ConnectednessBreakdown() (connected, disconnected int) {
+	peers := rt.ListPeers()
+	if rt.connectedness == nil {
+		return 0, len(peers)
+	}
+
+	for _, p := range peers {
+		if rt.connectedness(p) == network.Connected {
+			connected++
+		} else {
+			disconnected++
+		}
+	}
+	return connected, disconnected
+}
+
+// RecentlyAddedPeers returns the peers that were added to the Routing Table within the given duration.
+func (rt *RoutingTable) RecentlyAddedPeers(within time.Duration) []peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var peers []peer.ID
+	for _, buck := range rt.buckets {
+		for e := buck.list.Front(); e != nil; e = e.Next() {
+			if p := e.Value.(*PeerInfo); time.Since(p.AddedAt) <= within {
+				peers = append(peers, p.Id)
+			}
+		}
+	}
+	return peers
+}
+
+// PassivePeers returns the peers in the Routing Table that have never been useful to us, i.e. peers that
+// were added without being queried and whose LastUsefulAt time has never been set since.
+func (rt *RoutingTable) PassivePeers() []peer.ID {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var peers []peer.ID
+	for _, buck := range rt.buckets {
+		for e := buck.list.Front(); e != nil; e = e.Next() {
+			if p := e.Value.(*PeerInfo); p.LastUsefulAt.IsZero() {
+				peers = append(peers, p.Id)
+			}
+		}
+	}
+	return peers
+}
+
 // Print prints a descriptive statement about the provided RoutingTable
 func (rt *RoutingTable) Print() {
 	fmt.Printf("Routing Table, bs = %d, Max latency = %d\n", rt.bucketsize, rt.maxLatency)
-	rt.tabLock.RLock()
+	rt.rlockTable()
 
 	for i, b := range rt.buckets {
 		fmt.Printf("\tbucket: %d\n", i)
@@ -492,11 +1989,25 @@ func (rt *RoutingTable) GetDiversityStats() []peerdiversity.CplDiversityStats {
 
 // the caller is responsible for the locking
 func (rt *RoutingTable) bucketIdForPeer(p peer.ID) int {
-	peerID := ConvertPeerID(p)
-	cpl := CommonPrefixLen(peerID, rt.local)
-	bucketID := cpl
-	if bucketID >= len(rt.buckets) {
-		bucketID = len(rt.buckets) - 1
+	return rt.bucketIdForDhtId(ConvertPeerID(p))
+}
+
+// the caller is responsible for the locking
+func (rt *RoutingTable) bucketIdForDhtId(dhtId ID) int {
+	return ExpectedBucket(rt.local, dhtId, len(rt.buckets))
+}
+
+// ExpectedBucket returns the index of the bucket a peer with the given DHT ID belongs to in the
+// routing table of the given local ID, when that table has numBuckets buckets. Peers that share
+// more bits with the local ID than there are dedicated buckets belong to the last bucket.
+// A table always has at least one bucket, so a non-positive numBuckets is treated as one.
+func ExpectedBucket(local, peer ID, numBuckets int) int {
+	bucketID := CommonPrefixLen(peer, local)
+	if bucketID >= numBuckets {
+		bucketID = numBuckets - 1
+	}
+	if bucketID < 0 {
+		bucketID = 0
 	}
 	return bucketID
 }
@@ -504,7 +2015,7 @@ func (rt *RoutingTable) bucketIdForPeer(p peer.ID) int {
 // maxCommonPrefix returns the maximum common prefix length between any peer in
 // the table and the current peer.
 func (rt *RoutingTable) maxCommonPrefix() uint {
-	rt.tabLock.RLock()
+	rt.rlockTable()
 	defer rt.tabLock.RUnlock()
 
 	for i := len(rt.buckets) - 1; i >= 0; i-- {
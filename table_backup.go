@@ -0,0 +1,75 @@
+package kbucket
+
+import (
+	"errors"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrNoBackupTable is returned when promoting a peer from the backup table of a Routing Table that has none.
+var ErrNoBackupTable = errors.New("routing table has no backup table")
+
+// offerToBackup offers a peer the Routing Table evicted on its own to the backup table, if any.
+// The offer is queued like a notification, so that the backup table and its callbacks are only called
+// into once the table lock is released.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) offerToBackup(pi PeerInfo) {
+	backup := rt.backup
+	if backup == nil {
+		return
+	}
+	rt.queueNotification(func() {
+		if _, err := backup.TryAddPeer(pi.Id, false, pi.replaceable); err != nil {
+			log.Debugf("evicted peer %s not taken by the backup table: %s", pi.Id, err)
+		}
+	})
+}
+
+// CanPromoteFromBackup returns whether the given peer is in the backup table and there could be
+// room for it in this table, either because its bucket has a free slot or a replaceable peer, or
+// because its bucket is the last one and can be split.
+func (rt *RoutingTable) CanPromoteFromBackup(p peer.ID) bool {
+	if rt.backup == nil || rt.backup.Find(p) == "" {
+		return false
+	}
+
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	if rt.maxTableSize > 0 && rt.tableLoad() >= rt.maxTableSize && rt.tableFullPolicy == RejectWhenFull {
+		return false
+	}
+
+	bucketID := rt.bucketIdForPeer(p)
+	bucket := rt.buckets[bucketID]
+	if bucket.getPeer(p) != nil {
+		return false
+	}
+	if rt.occupied(bucketID) < rt.bucketsize || bucketID == len(rt.buckets)-1 {
+		return true
+	}
+	replaceable := bucket.min(func(p1 *PeerInfo, p2 *PeerInfo) bool {
+		return p1.replaceable
+	})
+	return replaceable != nil && replaceable.replaceable
+}
+
+// PromoteFromBackup moves the given peer from the backup table back into this table.
+// It returns false with a nil error if the peer is not in the backup table, and the error
+// of TryAddPeer if this table doesn't take it, in which case the peer stays in the backup table.
+// The promoted peer is added as a replaceable peer.
+func (rt *RoutingTable) PromoteFromBackup(p peer.ID) (bool, error) {
+	if rt.backup == nil {
+		return false, ErrNoBackupTable
+	}
+	if rt.backup.Find(p) == "" {
+		return false, nil
+	}
+
+	added, err := rt.TryAddPeer(p, false, true)
+	if err != nil || !added {
+		return false, err
+	}
+	rt.backup.RemovePeer(p)
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupTable(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	backup, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithBackupTable(backup))
+	require.NoError(t, err)
+
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		peers = append(peers, p)
+	}
+
+	// a replaced peer ends up in the backup table.
+	b, err := rt.TryAddPeer(peers[0], true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	b, err = rt.TryAddPeer(peers[1], true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []peer.ID{peers[0]}, backup.ListPeers())
+
+	// so does a stale one.
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(peers[1], time.Now().Add(-time.Hour)))
+	require.Equal(t, []peer.ID{peers[1]}, rt.RemoveStalePeers(time.Minute))
+	require.ElementsMatch(t, []peer.ID{peers[0], peers[1]}, backup.ListPeers())
+
+	// but not one the caller removes.
+	b, err = rt.TryAddPeer(peers[2], true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	rt.RemovePeer(peers[2])
+	require.NotContains(t, backup.ListPeers(), peers[2])
+
+	// peers come back from the backup table while there is room for them.
+	require.False(t, rt.CanPromoteFromBackup(peers[2]))
+	require.True(t, rt.CanPromoteFromBackup(peers[0]))
+	b, err = rt.PromoteFromBackup(peers[0])
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []peer.ID{peers[0]}, rt.ListPeers())
+	require.Equal(t, []peer.ID{peers[1]}, backup.ListPeers())
+
+	b, err = rt.PromoteFromBackup(peers[2])
+	require.NoError(t, err)
+	require.False(t, b)
+
+	_, err = backup.PromoteFromBackup(peers[1])
+	require.Equal(t, ErrNoBackupTable, err)
+	_, err = NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithBackupTable(nil))
+	require.Error(t, err)
+}
+
+func TestBackupTableCallbacks(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	backup, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithBackupTable(backup))
+	require.NoError(t, err)
+
+	// the backup table's callbacks can read the table that evicted the peer.
+	var sizes []int
+	backup.PeerAdded = func(peer.ID) { sizes = append(sizes, rt.Size()) }
+
+	p1, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	p2, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	b, err := rt.TryAddPeer(p1, true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	require.Equal(t, []int{1}, sizes)
+	require.Equal(t, []peer.ID{p1}, backup.ListPeers())
+}
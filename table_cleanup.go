@@ -0,0 +1,190 @@
+package kbucket
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// minPeerTTLSweepInterval is the shortest interval at which we look for peers whose TTL has expired.
+const minPeerTTLSweepInterval = 10 * time.Millisecond
+
+// peerTTLSweepInterval returns how often we look for expired peers given the configured TTL.
+// Checking twice per TTL bounds how long an expired peer can linger to half the TTL.
+func peerTTLSweepInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 2
+	if interval < minPeerTTLSweepInterval {
+		interval = minPeerTTLSweepInterval
+	}
+	return interval
+}
+
+// peerTTLForBucket returns the TTL of the peers in the bucket with the given index.
+func (rt *RoutingTable) peerTTLForBucket(bucketIndex int) time.Duration {
+	if rt.bucketTTL != nil {
+		if ttl := rt.bucketTTL(bucketIndex); ttl > 0 {
+			return ttl
+		}
+	}
+	return rt.peerTTL
+}
+
+// shortestPeerTTL returns the shortest TTL any bucket the table can have uses.
+func (rt *RoutingTable) shortestPeerTTL() time.Duration {
+	shortest := rt.peerTTL
+	if rt.bucketTTL == nil {
+		return shortest
+	}
+	for i := 0; i < rt.maxBuckets(); i++ {
+		if ttl := rt.peerTTLForBucket(i); ttl < shortest {
+			shortest = ttl
+		}
+	}
+	return shortest
+}
+
+// expirePeers periodically evicts the peers that haven't had a successful outbound query
+// within the configured TTL, until the Routing Table is closed.
+func (rt *RoutingTable) expirePeers() {
+	ticker := time.NewTicker(peerTTLSweepInterval(rt.shortestPeerTTL()))
+	defer ticker.Stop()
+	defer func() {
+		rt.sweepLk.Lock()
+		rt.sweeperRunning = false
+		rt.sweepLk.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-rt.sweepTrigger:
+		case <-rt.ctx.Done():
+			return
+		}
+
+		rt.sweepLk.Lock()
+		rt.lastSweepAt = time.Now()
+		done := rt.nextSweepDone
+		rt.nextSweepDone = make(chan struct{})
+		rt.sweepLk.Unlock()
+
+		expired, checked := rt.removeStalePeers(rt.peerTTLForBucket, rt.evictionVeto)
+		if len(expired) > 0 {
+			log.Debugf("evicted %d peers whose TTL expired", len(expired))
+		}
+
+		rt.sweepLk.Lock()
+		rt.lastSweepDoneAt = time.Now()
+		rt.lastSweepChecked = checked
+		rt.lastSweepEvicted = len(expired)
+		rt.sweepLk.Unlock()
+		close(done)
+	}
+}
+
+// TriggerRefresh makes the background worker started by WithPeerTTL sweep the table for expired peers
+// right away instead of waiting for its next tick, and returns once that sweep has completed.
+// Triggers that arrive while a sweep is pending are coalesced into it.
+// It returns immediately if the table has no peer TTL or once the table is closed.
+func (rt *RoutingTable) TriggerRefresh() {
+	if rt.peerTTL == 0 {
+		return
+	}
+
+	// the sweep we wait for is one that hasn't started yet.
+	rt.sweepLk.Lock()
+	done := rt.nextSweepDone
+	rt.sweepLk.Unlock()
+
+	select {
+	case rt.sweepTrigger <- struct{}{}:
+	default:
+		// a sweep is already pending.
+	}
+
+	select {
+	case <-done:
+	case <-rt.ctx.Done():
+	}
+}
+
+// LastRefreshRun returns when the background worker started by WithPeerTTL last woke up to sweep
+// the table, or the zero time if it never has. A watchdog can use it to detect a wedged worker.
+func (rt *RoutingTable) LastRefreshRun() time.Time {
+	rt.sweepLk.Lock()
+	defer rt.sweepLk.Unlock()
+	return rt.lastSweepAt
+}
+
+// LastSweepTime returns when the background worker started by WithPeerTTL last completed a sweep of
+// the table, or the zero time if it never has, which is always the case if the table has no peer TTL.
+func (rt *RoutingTable) LastSweepTime() time.Time {
+	rt.sweepLk.Lock()
+	defer rt.sweepLk.Unlock()
+	return rt.lastSweepDoneAt
+}
+
+// RefreshLoopRunning reports whether the background worker started by WithPeerTTL is running.
+// It is false if the table has no peer TTL, and becomes false once the table has been closed.
+func (rt *RoutingTable) RefreshLoopRunning() bool {
+	rt.sweepLk.Lock()
+	defer rt.sweepLk.Unlock()
+	return rt.sweeperRunning
+}
+
+// LastSweepStats returns how many peers the last sweep of the background worker started by WithPeerTTL
+// checked for liveness and how many of them it evicted, or zeros if no sweep has completed yet.
+// The worker doesn't ping peers, it checks when their last successful outbound query was, so pinged
+// counts the peers that were checked.
+func (rt *RoutingTable) LastSweepStats() (pinged, evicted int) {
+	rt.sweepLk.Lock()
+	defer rt.sweepLk.Unlock()
+	return rt.lastSweepChecked, rt.lastSweepEvicted
+}
+
+// ApplyLivenessResults records the outcome of liveness checks run outside the Routing Table, keyed by peer,
+// in a single acquisition of the table lock. A nil error counts as a successful outbound query at the current
+// time. A peer whose check failed is evicted the way the background worker started by WithPeerTTL evicts
+// expired peers, unless the function set with WithEvictionVeto spares it or, when WithConnectedness is set,
+// we are still connected to it. Peers that aren't in the table are ignored.
+func (rt *RoutingTable) ApplyLivenessResults(results map[peer.ID]error) {
+	// the connectedness function is called without holding the table lock.
+	var connected map[peer.ID]bool
+	if rt.connectedness != nil {
+		connected = make(map[peer.ID]bool)
+		for p, err := range results {
+			if err != nil && rt.connectedness(p) == network.Connected {
+				connected[p] = true
+			}
+		}
+	}
+
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return
+	}
+	now := time.Now()
+	for p, err := range results {
+		pi := rt.buckets[rt.bucketIdForPeer(p)].getPeer(p)
+		if pi == nil {
+			continue
+		}
+		if err == nil {
+			pi.LastSuccessfulOutboundQueryAt = now
+			rt.subscribers.publish(PeerUpdatedChange, p)
+			continue
+		}
+		if connected[p] || (rt.evictionVeto != nil && rt.evictionVeto(p)) {
+			continue
+		}
+		failed := *pi
+		if rt.removePeerWithDhtId(failed.Id, failed.dhtId) {
+			log.Debugf("evicted peer %s after a failed liveness check: %s", p, err)
+			rt.offerToBackup(failed)
+			rt.promoteReplacement(failed.dhtId)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package kbucket
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerTTL(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(100*time.Millisecond))
+	require.NoError(t, err)
+	defer rt.Close()
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	b, err = rt.TryAddPeer(p2, false, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// only the peer whose TTL has expired is evicted.
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p2, time.Now().Add(time.Hour)))
+	require.Eventually(t, func() bool {
+		return rt.Find(p1) == ""
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, p2, rt.Find(p2))
+
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(-time.Second))
+	require.Error(t, err)
+}
+
+func TestTriggerRefresh(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	// nothing to do without a TTL.
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	rt.TriggerRefresh()
+	require.NoError(t, rt.Close())
+
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(time.Hour))
+	require.NoError(t, err)
+
+	p := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, time.Now().Add(-2*time.Hour)))
+
+	// the expired peer is gone as soon as the triggered sweep returns, long before the next tick.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rt.TriggerRefresh()
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, rt.Find(p))
+
+	// triggering a closed table doesn't block.
+	require.NoError(t, rt.Close())
+	rt.TriggerRefresh()
+}
+
+func TestSweepTimes(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.False(t, rt.RefreshLoopRunning())
+	require.True(t, rt.LastRefreshRun().IsZero())
+	require.True(t, rt.LastSweepTime().IsZero())
+	require.NoError(t, rt.Close())
+
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(time.Hour))
+	require.NoError(t, err)
+	require.True(t, rt.RefreshLoopRunning())
+	require.True(t, rt.LastRefreshRun().IsZero())
+
+	require.True(t, rt.LastSweepTime().IsZero())
+
+	before := time.Now()
+	rt.TriggerRefresh()
+	require.False(t, rt.LastRefreshRun().Before(before))
+	require.False(t, rt.LastSweepTime().Before(rt.LastRefreshRun()))
+
+	require.NoError(t, rt.Close())
+	require.Eventually(t, func() bool {
+		return !rt.RefreshLoopRunning()
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestEvictionVeto(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	protected := test.RandPeerIDFatal(t)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithPeerTTL(time.Hour), WithEvictionVeto(func(p peer.ID) bool {
+			return p == protected
+		}))
+	require.NoError(t, err)
+	defer rt.Close()
+
+	other := test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{protected, other} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, time.Now().Add(-2*time.Hour)))
+	}
+
+	rt.TriggerRefresh()
+	require.Equal(t, []peer.ID{protected}, rt.ListPeers())
+
+	// the vetoed peer is still stale, the veto only applies to the background worker.
+	require.Equal(t, []peer.ID{protected}, rt.RemoveStalePeers(time.Hour))
+}
+
+func TestTinyPeerTTL(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	// a TTL too short to be halved into a valid ticker interval must not crash the background worker.
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(time.Nanosecond))
+	require.NoError(t, err)
+	defer rt.Close()
+	require.Equal(t, minPeerTTLSweepInterval, peerTTLSweepInterval(time.Nanosecond))
+
+	b, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	rt.TriggerRefresh()
+	require.Zero(t, rt.Size())
+}
+
+func TestLastSweepStats(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(time.Hour))
+	require.NoError(t, err)
+	defer rt.Close()
+
+	pinged, evicted := rt.LastSweepStats()
+	require.Zero(t, pinged)
+	require.Zero(t, evicted)
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p1, time.Now().Add(-2*time.Hour)))
+
+	rt.TriggerRefresh()
+	pinged, evicted = rt.LastSweepStats()
+	require.Equal(t, 2, pinged)
+	require.Equal(t, 1, evicted)
+
+	rt.TriggerRefresh()
+	pinged, evicted = rt.LastSweepStats()
+	require.Equal(t, 1, pinged)
+	require.Zero(t, evicted)
+}
+
+func TestBucketRefreshIntervalFunc(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	_, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithBucketRefreshIntervalFunc(nil), WithPeerTTL(time.Hour))
+	require.Error(t, err)
+	_, err = NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithBucketRefreshIntervalFunc(func(int) time.Duration { return time.Minute }))
+	require.Error(t, err)
+
+	// peers in the first bucket expire quickly, the others use the uniform TTL.
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerTTL(time.Hour),
+		WithBucketRefreshIntervalFunc(func(bucketIndex int) time.Duration {
+			if bucketIndex == 0 {
+				return 100 * time.Millisecond
+			}
+			return 0
+		}))
+	require.NoError(t, err)
+	defer rt.Close()
+
+	p0, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	p1, err := rt.GenRandPeerID(1)
+	require.NoError(t, err)
+	// a third bucket keeps the first one from being collapsed, which would move p1 into it, once p0 expires.
+	p2, err := rt.GenRandPeerID(2)
+	require.NoError(t, err)
+	for _, p := range []peer.ID{p0, p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+
+	require.Eventually(t, func() bool {
+		return rt.Find(p0) == ""
+	}, 5*time.Second, 10*time.Millisecond)
+	rt.TriggerRefresh()
+	require.Equal(t, p1, rt.Find(p1))
+	require.Equal(t, p2, rt.Find(p2))
+}
+
+func TestApplyLivenessResults(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	var spared, connected peer.ID
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithEvictionVeto(func(p peer.ID) bool { return p == spared }),
+		WithConnectedness(func(p peer.ID) network.Connectedness {
+			if p == connected {
+				return network.Connected
+			}
+			return network.NotConnected
+		}))
+	require.NoError(t, err)
+
+	alive := test.RandPeerIDFatal(t)
+	dead := test.RandPeerIDFatal(t)
+	spared = test.RandPeerIDFatal(t)
+	connected = test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{alive, dead, spared, connected} {
+		rt.TryAddPeer(p, false, false)
+	}
+
+	before := time.Now()
+	probeErr := errors.New("no response")
+	rt.ApplyLivenessResults(map[peer.ID]error{
+		alive:                   nil,
+		dead:                    probeErr,
+		spared:                  probeErr,
+		connected:               probeErr,
+		test.RandPeerIDFatal(t): probeErr,
+	})
+	require.ElementsMatch(t, []peer.ID{alive, spared, connected}, rt.ListPeers())
+	for _, pi := range rt.GetPeerInfos() {
+		if pi.Id == alive {
+			require.False(t, pi.LastSuccessfulOutboundQueryAt.Before(before))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package kbucket
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// closestAdded updates the peer closest to us after the given peer was added to the Routing Table.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) closestAdded(p peer.ID, dhtId ID) {
+	if rt.closestToSelf != "" && !xor(dhtId, rt.local).less(xor(rt.closestDhtId, rt.local)) {
+		return
+	}
+	rt.setClosest(p, dhtId)
+}
+
+// closestRemoved updates the peer closest to us after the given peer was removed from the Routing Table.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) closestRemoved(p peer.ID) {
+	if p != rt.closestToSelf {
+		return
+	}
+
+	// the closest peers to us share the longest prefix with us, so they are all in the last non-empty bucket.
+	for i := len(rt.buckets) - 1; i >= 0; i-- {
+		var closest *PeerInfo
+		for e := rt.buckets[i].list.Front(); e != nil; e = e.Next() {
+			if pi := e.Value.(*PeerInfo); closest == nil || xor(pi.dhtId, rt.local).less(xor(closest.dhtId, rt.local)) {
+				closest = pi
+			}
+		}
+		if closest != nil {
+			rt.setClosest(closest.Id, closest.dhtId)
+			return
+		}
+	}
+	rt.setClosest("", nil)
+}
+
+// setClosest records the peer closest to us, queueing the notification if it changed.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) setClosest(p peer.ID, dhtId ID) {
+	old := rt.closestToSelf
+	rt.closestToSelf, rt.closestDhtId = p, dhtId
+	if changed := rt.OnClosestPeerChanged; changed != nil && old != p {
+		rt.queueNotification(func() { changed(old, p) })
+	}
+}
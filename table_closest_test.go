@@ -0,0 +1,49 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnClosestPeerChanged(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var changes [][2]peer.ID
+	rt.OnClosestPeerChanged = func(old, new peer.ID) {
+		changes = append(changes, [2]peer.ID{old, new})
+	}
+
+	far, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	near, err := rt.GenRandPeerID(5)
+	require.NoError(t, err)
+	nearer, err := rt.GenRandPeerID(8)
+	require.NoError(t, err)
+
+	rt.TryAddPeer(far, true, false)
+	require.Equal(t, [][2]peer.ID{{"", far}}, changes)
+
+	rt.TryAddPeer(nearer, true, false)
+	require.Equal(t, [][2]peer.ID{{far, nearer}}, changes[1:])
+
+	// adding or removing a peer that isn't the closest one changes nothing.
+	rt.TryAddPeer(near, true, false)
+	rt.RemovePeer(near)
+	require.Len(t, changes, 2)
+
+	rt.RemovePeer(nearer)
+	require.Equal(t, [][2]peer.ID{{nearer, far}}, changes[2:])
+	rt.RemovePeer(far)
+	require.Equal(t, [][2]peer.ID{{far, ""}}, changes[3:])
+}
@@ -0,0 +1,40 @@
+package kbucket
+
+import (
+	"sync/atomic"
+)
+
+// Counters holds the number of times each event happened over the lifetime of a Routing Table.
+type Counters struct {
+	// Added is the number of peers added to the table, including the ones that replaced another peer.
+	Added uint64
+	// Removed is the number of peers removed from the table, for whatever reason.
+	Removed uint64
+	// RejectedHighLatency is the number of peers rejected because their latency was too high.
+	RejectedHighLatency uint64
+	// RejectedNoCapacity is the number of peers rejected for lack of room in their bucket or in the table.
+	RejectedNoCapacity uint64
+	// Replaced is the number of peers evicted to make room for a new peer.
+	Replaced uint64
+}
+
+// tableCounters is allocated on its own so that its fields are 64-bit aligned for atomic access.
+type tableCounters struct {
+	added               uint64
+	removed             uint64
+	rejectedHighLatency uint64
+	rejectedNoCapacity  uint64
+	replaced            uint64
+}
+
+// Counters returns the lifetime event counters of the Routing Table.
+// Reading them doesn't take the table lock, so they may be slightly out of sync with each other.
+func (rt *RoutingTable) Counters() Counters {
+	return Counters{
+		Added:               atomic.LoadUint64(&rt.counters.added),
+		Removed:             atomic.LoadUint64(&rt.counters.removed),
+		RejectedHighLatency: atomic.LoadUint64(&rt.counters.rejectedHighLatency),
+		RejectedNoCapacity:  atomic.LoadUint64(&rt.counters.rejectedNoCapacity),
+		Replaced:            atomic.LoadUint64(&rt.counters.replaced),
+	}
+}
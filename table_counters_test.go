@@ -0,0 +1,59 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounters(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), 10*time.Millisecond, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Equal(t, Counters{}, rt.Counters())
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		peers = append(peers, p)
+	}
+
+	// added, then replaced by a new peer.
+	b, err := rt.TryAddPeer(peers[0], true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	b, err = rt.TryAddPeer(peers[1], true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// no room left for a peer, and one which is too slow.
+	_, err = rt.TryAddPeer(peers[2], true, false)
+	require.Equal(t, ErrPeerRejectedNoCapacity, err)
+	m.RecordLatency(peers[3], time.Second)
+	_, err = rt.TryAddPeer(peers[3], true, false)
+	require.Equal(t, ErrPeerRejectedHighLatency, err)
+
+	// adding an existing peer doesn't count.
+	b, err = rt.TryAddPeer(peers[1], true, false)
+	require.NoError(t, err)
+	require.False(t, b)
+
+	rt.RemovePeer(peers[1])
+	require.Equal(t, Counters{
+		Added:               2,
+		Removed:             2,
+		RejectedHighLatency: 1,
+		RejectedNoCapacity:  1,
+		Replaced:            1,
+	}, rt.Counters())
+}
@@ -0,0 +1,39 @@
+package kbucket
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+var csvHeader = []string{"peer_id", "bucket", "cpl", "last_successful_outbound_query_at", "latency_ewma_ns", "added_at"}
+
+// ExportCSV writes one row per peer in the routing table to w in CSV format, preceded by a header.
+// Timestamps are formatted as RFC 3339 and the latency EWMA is written in nanoseconds.
+// The rows are collected under the table's read lock, but the lock is not held while writing to w.
+func (rt *RoutingTable) ExportCSV(w io.Writer) error {
+	rows := [][]string{csvHeader}
+
+	rt.rlockTable()
+	for i, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			rows = append(rows, []string{
+				p.Id.String(),
+				strconv.Itoa(i),
+				strconv.Itoa(CommonPrefixLen(p.dhtId, rt.local)),
+				p.LastSuccessfulOutboundQueryAt.Format(time.RFC3339Nano),
+				strconv.FormatInt(int64(rt.metrics.LatencyEWMA(p.Id)), 10),
+				p.AddedAt.Format(time.RFC3339Nano),
+			})
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,69 @@
+package kbucket
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCSV(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(2)
+	m.RecordLatency(p2, 10*time.Millisecond)
+	for _, p := range []peer.ID{p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, rt.ExportCSV(&buf))
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	require.Equal(t, csvHeader, rows[0])
+
+	byPeer := make(map[string][]string)
+	for _, row := range rows[1:] {
+		byPeer[row[0]] = row
+	}
+
+	rt.tabLock.RLock()
+	bucket := rt.bucketIdForPeer(p2)
+	rt.tabLock.RUnlock()
+
+	row := byPeer[p2.String()]
+	require.NotNil(t, row)
+	require.Equal(t, strconv.Itoa(bucket), row[1])
+	require.Equal(t, "2", row[2])
+	latency, err := strconv.ParseInt(row[4], 10, 64)
+	require.NoError(t, err)
+	require.Equal(t, m.LatencyEWMA(p2), time.Duration(latency))
+	_, err = time.Parse(time.RFC3339Nano, row[3])
+	require.NoError(t, err)
+	_, err = time.Parse(time.RFC3339Nano, row[5])
+	require.NoError(t, err)
+
+	row = byPeer[p1.String()]
+	require.NotNil(t, row)
+	require.Equal(t, "0", row[1])
+	require.Equal(t, "0", row[2])
+	require.Equal(t, "0", row[4])
+}
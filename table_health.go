@@ -0,0 +1,89 @@
+package kbucket
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// HealthReport returns a human readable, multi-line summary of the state of the Routing Table, meant for
+// CLI tools and debug endpoints: its size, how full each bucket is, how many peers we are connected to,
+// their average latency, the Cpls that have never been refreshed and the outcome of the last sweep.
+// The table itself is inspected under a single acquisition of the read lock, so those numbers are consistent
+// with each other. Its format is not stable and should not be parsed.
+func (rt *RoutingTable) HealthReport() string {
+	var (
+		peers      []peer.ID
+		fill       []int
+		totalLat   time.Duration
+		measured   int
+		highestCpl uint
+	)
+	rt.rlockTable()
+	for _, b := range rt.buckets {
+		fill = append(fill, b.len())
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			peers = append(peers, p.Id)
+			if l := rt.metrics.LatencyEWMA(p.Id); l > 0 {
+				totalLat += l
+				measured++
+			}
+		}
+		if b.len() > 0 {
+			// the Cpls tracked for refresh go up to the highest one in the table, see GetTrackedCplsForRefresh.
+			highestCpl = b.maxCommonPrefix(rt.local)
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Routing Table health\n")
+	fmt.Fprintf(&sb, "\tsize: %d peers in %d buckets of %d\n", len(peers), len(fill), rt.bucketsize)
+	for i, n := range fill {
+		fmt.Fprintf(&sb, "\tbucket %d: %d/%d\n", i, n, rt.bucketsize)
+	}
+
+	// the connectedness function is called without holding the table lock.
+	if rt.connectedness == nil {
+		fmt.Fprintf(&sb, "\tconnected: unknown\n")
+	} else {
+		connected := 0
+		for _, p := range peers {
+			if rt.connectedness(p) == network.Connected {
+				connected++
+			}
+		}
+		fmt.Fprintf(&sb, "\tconnected: %d/%d\n", connected, len(peers))
+	}
+
+	if measured == 0 {
+		fmt.Fprintf(&sb, "\taverage latency: unknown\n")
+	} else {
+		fmt.Fprintf(&sb, "\taverage latency: %s over %d peers\n", totalLat/time.Duration(measured), measured)
+	}
+
+	if highestCpl > maxCplForRefresh {
+		highestCpl = maxCplForRefresh
+	}
+	var neverRefreshed []string
+	rt.cplRefreshLk.RLock()
+	for cpl := uint(0); cpl <= highestCpl; cpl++ {
+		if rt.cplRefreshedAt[cpl].IsZero() {
+			neverRefreshed = append(neverRefreshed, fmt.Sprint(cpl))
+		}
+	}
+	rt.cplRefreshLk.RUnlock()
+	fmt.Fprintf(&sb, "\tcpls never refreshed: [%s]\n", strings.Join(neverRefreshed, " "))
+
+	if at := rt.LastSweepTime(); at.IsZero() {
+		fmt.Fprintf(&sb, "\tlast sweep: never\n")
+	} else {
+		checked, evicted := rt.LastSweepStats()
+		fmt.Fprintf(&sb, "\tlast sweep: %s, checked %d peers, evicted %d\n", at.Format(time.RFC3339), checked, evicted)
+	}
+	return sb.String()
+}
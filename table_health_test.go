@@ -0,0 +1,60 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthReport(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	report := rt.HealthReport()
+	require.Contains(t, report, "size: 0 peers in 1 buckets of 2\n")
+	require.Contains(t, report, "connected: unknown\n")
+	require.Contains(t, report, "average latency: unknown\n")
+	require.Contains(t, report, "last sweep: never\n")
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(1)
+	p3, _ := rt.GenRandPeerID(1)
+	m.RecordLatency(p1, 10*time.Millisecond)
+	m.RecordLatency(p2, 30*time.Millisecond)
+	connected := map[peer.ID]bool{p1: true}
+	rt, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithConnectedness(func(p peer.ID) network.Connectedness {
+			if connected[p] {
+				return network.Connected
+			}
+			return network.NotConnected
+		}), WithPeerTTL(time.Hour))
+	require.NoError(t, err)
+	defer rt.Close()
+	for _, p := range []peer.ID{p1, p2, p3} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	rt.ResetCplRefreshedAtForID(ConvertPeerID(p2), time.Now())
+	rt.TriggerRefresh()
+
+	report = rt.HealthReport()
+	require.Contains(t, report, "size: 3 peers in 2 buckets of 2\n")
+	require.Contains(t, report, "bucket 0: 1/2\n")
+	require.Contains(t, report, "bucket 1: 2/2\n")
+	require.Contains(t, report, "connected: 1/3\n")
+	require.Contains(t, report, "average latency: 20ms over 2 peers\n")
+	require.Contains(t, report, "cpls never refreshed: [0]\n")
+	require.Contains(t, report, "checked 3 peers, evicted 0\n")
+}
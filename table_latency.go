@@ -0,0 +1,31 @@
+package kbucket
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StaleLatencyPolicy decides how a peer whose latency sample is too old to be trusted is admitted,
+// see WithLatencySampleMaxAge.
+type StaleLatencyPolicy int
+
+const (
+	// AdmitStaleLatency admits the peer as if we had never measured its latency.
+	AdmitStaleLatency StaleLatencyPolicy = iota
+	// RejectStaleLatency rejects the peer with ErrPeerRejectedHighLatency.
+	RejectStaleLatency
+)
+
+// admissionLatency returns the latency of the peer the latency gate goes by, and whether it lets the peer in.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) admissionLatency(p peer.ID) (time.Duration, bool) {
+	latency := rt.metrics.LatencyEWMA(p)
+	// a zero latency means we have never measured it, so there's no sample to be stale.
+	if rt.latencySampledAt != nil && latency != 0 {
+		if at := rt.latencySampledAt(p); at.IsZero() || time.Since(at) > rt.latencyMaxAge {
+			return 0, rt.staleLatencyPolicy == AdmitStaleLatency
+		}
+	}
+	return latency, latency <= rt.maxLatency
+}
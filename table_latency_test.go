@@ -0,0 +1,65 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencySampleMaxAge(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	sampledAt := make(map[peer.ID]time.Time)
+	sampledAtFn := func(p peer.ID) time.Time { return sampledAt[p] }
+
+	_, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithLatencySampleMaxAge(nil, time.Minute, AdmitStaleLatency))
+	require.Error(t, err)
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithLatencySampleMaxAge(sampledAtFn, 0, AdmitStaleLatency))
+	require.Error(t, err)
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithLatencySampleMaxAge(sampledAtFn, time.Minute, StaleLatencyPolicy(-1)))
+	require.Error(t, err)
+
+	// all peers but unmeasured are too slow, but only fresh was measured recently.
+	slow := test.RandPeerIDFatal(t)
+	fresh := test.RandPeerIDFatal(t)
+	unknownAge := test.RandPeerIDFatal(t)
+	unmeasured := test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{slow, fresh, unknownAge} {
+		m.RecordLatency(p, 2*time.Hour)
+	}
+	sampledAt[slow] = time.Now().Add(-time.Hour)
+	sampledAt[fresh] = time.Now()
+
+	for _, tc := range []struct {
+		policy StaleLatencyPolicy
+		added  map[peer.ID]bool
+	}{
+		{AdmitStaleLatency, map[peer.ID]bool{slow: true, fresh: false, unknownAge: true, unmeasured: true}},
+		{RejectStaleLatency, map[peer.ID]bool{slow: false, fresh: false, unknownAge: false, unmeasured: true}},
+	} {
+		rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithLatencySampleMaxAge(sampledAtFn, time.Minute, tc.policy))
+		require.NoError(t, err)
+		for p, added := range tc.added {
+			b, err := rt.TryAddPeer(p, true, false)
+			require.Equal(t, added, b)
+			if added {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrPeerRejectedHighLatency)
+			}
+		}
+	}
+
+	// without the option, every sample is trusted.
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	_, err = rt.TryAddPeer(slow, true, false)
+	require.ErrorIs(t, err, ErrPeerRejectedHighLatency)
+}
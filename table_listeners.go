@@ -0,0 +1,70 @@
+package kbucket
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type peerListener struct {
+	id uint64
+	fn func(peer.ID)
+}
+
+// peerListeners is a set of functions notified of a peer event, in the order they were registered.
+type peerListeners struct {
+	lk     sync.Mutex
+	nextId uint64
+	// the slice is never modified in place, so that it can be iterated without holding the lock.
+	listeners []peerListener
+}
+
+// add registers fn and returns a function that unregisters it.
+func (pl *peerListeners) add(fn func(peer.ID)) (cancel func()) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+
+	pl.nextId++
+	id := pl.nextId
+	listeners := make([]peerListener, len(pl.listeners), len(pl.listeners)+1)
+	copy(listeners, pl.listeners)
+	pl.listeners = append(listeners, peerListener{id: id, fn: fn})
+
+	return func() {
+		pl.lk.Lock()
+		defer pl.lk.Unlock()
+
+		listeners := make([]peerListener, 0, len(pl.listeners))
+		for _, l := range pl.listeners {
+			if l.id != id {
+				listeners = append(listeners, l)
+			}
+		}
+		pl.listeners = listeners
+	}
+}
+
+// notify calls all registered functions with the given peer.
+func (pl *peerListeners) notify(p peer.ID) {
+	pl.lk.Lock()
+	listeners := pl.listeners
+	pl.lk.Unlock()
+
+	for _, l := range listeners {
+		l.fn(p)
+	}
+}
+
+// OnPeerAdded registers a function to be called whenever a peer is added to the Routing Table, and returns
+// a function that unregisters it. Functions are called in the order they were registered, after the PeerAdded
+// field, once the table lock has been released. Unlike the PeerAdded field, any number of them can be registered.
+func (rt *RoutingTable) OnPeerAdded(fn func(peer.ID)) (cancel func()) {
+	return rt.addedListeners.add(fn)
+}
+
+// OnPeerRemoved registers a function to be called whenever a peer is removed from the Routing Table, and returns
+// a function that unregisters it. Functions are called in the order they were registered, after the PeerRemoved
+// field, once the table lock has been released. Unlike the PeerRemoved field, any number of them can be registered.
+func (rt *RoutingTable) OnPeerRemoved(fn func(peer.ID)) (cancel func()) {
+	return rt.removedListeners.add(fn)
+}
@@ -0,0 +1,58 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerListeners(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var events []string
+	rt.PeerAdded = func(peer.ID) { events = append(events, "field added") }
+	rt.PeerRemoved = func(peer.ID) { events = append(events, "field removed") }
+	cancel1 := rt.OnPeerAdded(func(peer.ID) { events = append(events, "added 1") })
+	cancel2 := rt.OnPeerAdded(func(peer.ID) { events = append(events, "added 2") })
+	cancel3 := rt.OnPeerRemoved(func(peer.ID) { events = append(events, "removed") })
+
+	p := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	rt.RemovePeer(p)
+	require.Equal(t, []string{"field added", "added 1", "added 2", "field removed", "removed"}, events)
+
+	// cancelling only unregisters the listener it was returned with, and is idempotent.
+	events = nil
+	cancel1()
+	cancel1()
+	cancel3()
+	b, err = rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	rt.RemovePeer(p)
+	require.Equal(t, []string{"field added", "added 2", "field removed"}, events)
+
+	// listeners can unregister themselves.
+	events = nil
+	cancel2()
+	var cancel func()
+	cancel = rt.OnPeerAdded(func(peer.ID) {
+		events = append(events, "once")
+		cancel()
+	})
+	rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.Equal(t, []string{"field added", "once", "field added"}, events)
+}
@@ -0,0 +1,84 @@
+package kbucket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LockStats describes how long callers waited to acquire the table lock, see WithLockMetrics.
+type LockStats struct {
+	// ReadAcquisitions is the number of times the lock was acquired for reading.
+	ReadAcquisitions uint64
+	// ReadWait is the total time spent waiting to acquire the lock for reading.
+	ReadWait time.Duration
+	// WriteAcquisitions is the number of times the lock was acquired for writing.
+	WriteAcquisitions uint64
+	// WriteWait is the total time spent waiting to acquire the lock for writing.
+	WriteWait time.Duration
+}
+
+// lockMetrics is allocated on its own so that its fields are 64-bit aligned for atomic access.
+type lockMetrics struct {
+	readAcquisitions  uint64
+	readWaitNs        uint64
+	writeAcquisitions uint64
+	writeWaitNs       uint64
+}
+
+// lockTable acquires the table lock for writing, recording how long it took if lock metrics are enabled.
+func (rt *RoutingTable) lockTable() {
+	if rt.lockMetrics == nil {
+		rt.tabLock.Lock()
+		return
+	}
+
+	start := time.Now()
+	rt.tabLock.Lock()
+	atomic.AddUint64(&rt.lockMetrics.writeWaitNs, uint64(time.Since(start)))
+	atomic.AddUint64(&rt.lockMetrics.writeAcquisitions, 1)
+}
+
+// unlockTable releases the table lock held for writing, then fires the notifications queued while it was held,
+// so that they can call back into the table. Notifications fired by concurrent writers aren't ordered.
+func (rt *RoutingTable) unlockTable() {
+	pending := rt.pendingNotifications
+	rt.pendingNotifications = nil
+	rt.tabLock.Unlock()
+
+	for _, notify := range pending {
+		notify()
+	}
+}
+
+// queueNotification queues a notification to be fired once the table lock is released, see unlockTable.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) queueNotification(notify func()) {
+	rt.pendingNotifications = append(rt.pendingNotifications, notify)
+}
+
+// rlockTable acquires the table lock for reading, recording how long it took if lock metrics are enabled.
+func (rt *RoutingTable) rlockTable() {
+	if rt.lockMetrics == nil {
+		rt.tabLock.RLock()
+		return
+	}
+
+	start := time.Now()
+	rt.tabLock.RLock()
+	atomic.AddUint64(&rt.lockMetrics.readWaitNs, uint64(time.Since(start)))
+	atomic.AddUint64(&rt.lockMetrics.readAcquisitions, 1)
+}
+
+// LockStats returns how long callers waited to acquire the table lock so far.
+// It is always zero unless the table was created with WithLockMetrics.
+func (rt *RoutingTable) LockStats() LockStats {
+	if rt.lockMetrics == nil {
+		return LockStats{}
+	}
+	return LockStats{
+		ReadAcquisitions:  atomic.LoadUint64(&rt.lockMetrics.readAcquisitions),
+		ReadWait:          time.Duration(atomic.LoadUint64(&rt.lockMetrics.readWaitNs)),
+		WriteAcquisitions: atomic.LoadUint64(&rt.lockMetrics.writeAcquisitions),
+		WriteWait:         time.Duration(atomic.LoadUint64(&rt.lockMetrics.writeWaitNs)),
+	}
+}
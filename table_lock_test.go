@@ -0,0 +1,50 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockStats(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	rt.ListPeers()
+	require.Equal(t, LockStats{}, rt.LockStats())
+
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithLockMetrics())
+	require.NoError(t, err)
+	rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	rt.ListPeers()
+	rt.ListPeers()
+	stats := rt.LockStats()
+	require.Equal(t, uint64(1), stats.WriteAcquisitions)
+	require.Equal(t, uint64(2), stats.ReadAcquisitions)
+
+	// time spent waiting on a held lock is accounted for.
+	const hold = 20 * time.Millisecond
+	rt.tabLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+		close(done)
+	}()
+	time.Sleep(hold)
+	rt.tabLock.Unlock()
+	<-done
+
+	stats = rt.LockStats()
+	require.Equal(t, uint64(2), stats.WriteAcquisitions)
+	require.GreaterOrEqual(t, stats.WriteWait, hold/2)
+}
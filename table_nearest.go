@@ -0,0 +1,291 @@
+package kbucket
+
+import (
+	"sort"
+
+	ks "github.com/libp2p/go-libp2p-kbucket/keyspace"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// NearestPeersIter returns an iterator that yields the peers in the routing table in ascending order
+// of distance to the given ID. The second return value of the iterator is false once all peers have
+// been yielded.
+//
+// The iterator reflects the state of the table at the time NearestPeersIter was called; peers added
+// or removed afterwards are not taken into account. Distances are only computed and sorted one group
+// of buckets at a time as the iterator advances, so callers that stop early don't pay for sorting
+// the whole table.
+func (rt *RoutingTable) NearestPeersIter(id ID) func() (peer.ID, bool) {
+	// The buckets are visited in the same order as in NearestPeers: the target bucket first,
+	// then all buckets to its right together as they all share the same number of bits with the key,
+	// then the buckets to its left one by one.
+	var groups [][]PeerInfo
+
+	rt.rlockTable()
+	cpl := CommonPrefixLen(id, rt.local)
+	if cpl >= len(rt.buckets) {
+		cpl = len(rt.buckets) - 1
+	}
+	groups = append(groups, rt.buckets[cpl].peers())
+
+	var right []PeerInfo
+	for i := cpl + 1; i < len(rt.buckets); i++ {
+		right = append(right, rt.buckets[i].peers()...)
+	}
+	groups = append(groups, right)
+
+	for i := cpl - 1; i >= 0; i-- {
+		groups = append(groups, rt.buckets[i].peers())
+	}
+	rt.tabLock.RUnlock()
+
+	var current []peerDistance
+	return func() (peer.ID, bool) {
+		for len(current) == 0 {
+			if len(groups) == 0 {
+				return "", false
+			}
+
+			pds := peerDistanceSorter{
+				peers:  make([]peerDistance, 0, len(groups[0])),
+				target: id,
+			}
+			for _, p := range groups[0] {
+				pds.appendPeer(p.Id, p.dhtId)
+			}
+			pds.sort()
+
+			current = pds.peers
+			groups = groups[1:]
+		}
+
+		p := current[0].p
+		current = current[1:]
+		return p, true
+	}
+}
+
+// KthNearestPeer returns the peer at the 0-based position k in ascending order of distance to the
+// given ID. It returns false if the routing table holds fewer than k+1 peers.
+//
+// Only the k+1 closest peers are kept while scanning the table, so this is cheap for small values of k.
+func (rt *RoutingTable) KthNearestPeer(id ID, k int) (peer.ID, bool) {
+	if k < 0 {
+		return "", false
+	}
+
+	pdh := peerDistanceHeap{
+		peers:  make([]peerDistance, 0, k+1),
+		target: id,
+		count:  k + 1,
+	}
+	rt.rlockTable()
+	rt.collectNearest(&pdh, id, k+1)
+	rt.tabLock.RUnlock()
+
+	if pdh.Len() <= k {
+		return "", false
+	}
+	// the root of the heap is the farthest of the k+1 closest peers.
+	return pdh.peers[0].p, true
+}
+
+// FarthestPeer returns the peer in the routing table with the largest xor distance to the given ID.
+// It returns false if the routing table is empty.
+//
+// The farthest peer can be in any bucket, so this scans the whole table.
+func (rt *RoutingTable) FarthestPeer(id ID) (peer.ID, bool) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	var farthest peerDistance
+	found := false
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			pi := e.Value.(*PeerInfo)
+			if d := xor(id, pi.dhtId); !found || farthest.distance.less(d) {
+				farthest = peerDistance{p: pi.Id, distance: d}
+				found = true
+			}
+		}
+	}
+	return farthest.p, found
+}
+
+// NearestPeersByCpl returns the same peers as NearestPeers, grouped by their Cpl with the given ID.
+// Within a group, peers are ordered from the closest to the farthest.
+func (rt *RoutingTable) NearestPeersByCpl(id ID, count int) map[int][]peer.ID {
+	byCpl := make(map[int][]peer.ID)
+	for _, p := range rt.NearestPeers(id, count) {
+		cpl := CommonPrefixLen(id, ConvertPeerID(p))
+		byCpl[cpl] = append(byCpl[cpl], p)
+	}
+	return byCpl
+}
+
+// NearestPeersMulti returns the 'count' closest peers to each of the given IDs, as NearestPeers would, keyed by
+// string(id). All the nearest peers are gathered under a single acquisition of the read lock, which is cheaper
+// than calling NearestPeers for each ID when the table is contended.
+func (rt *RoutingTable) NearestPeersMulti(ids []ID, count int) map[string][]peer.ID {
+	useHeap := count <= nearestPeersHeapMaxCount
+	collected := make([][]peerDistance, len(ids))
+
+	rt.rlockTable()
+	for i, id := range ids {
+		if useHeap {
+			pdh := peerDistanceHeap{
+				peers:  make([]peerDistance, 0, count),
+				target: id,
+				count:  count,
+			}
+			rt.collectNearest(&pdh, id, count)
+			collected[i] = pdh.sorted()
+		} else {
+			pdsr := peerDistanceSorter{
+				peers:  make([]peerDistance, 0, count+rt.bucketsize),
+				target: id,
+			}
+			rt.collectNearest(&pdsr, id, count)
+			collected[i] = pdsr.peers
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	out := make(map[string][]peer.ID, len(ids))
+	for i, id := range ids {
+		pds := collected[i]
+		if !useHeap {
+			// the candidates can be sorted without holding the lock.
+			pdsr := peerDistanceSorter{peers: pds, target: id}
+			pdsr.sort()
+		}
+		if count < len(pds) {
+			pds = pds[:count]
+		}
+
+		peers := make([]peer.ID, 0, len(pds))
+		for _, p := range pds {
+			peers = append(peers, p.p)
+		}
+		out[string(id)] = peers
+	}
+	return out
+}
+
+// AmClosest reports whether the local ID is closer to the given target than every peer in the routing table,
+// e.g. to decide whether we are responsible for a key. It returns true if the routing table is empty.
+//
+// This scans the table until it finds a closer peer, without sorting the peers.
+func (rt *RoutingTable) AmClosest(target ID) bool {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	local := xor(rt.local, target)
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			if xor(e.Value.(*PeerInfo).dhtId, target).less(local) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NearestPeersAcrossTables returns the 'count' closest peers to the given ID among all the given
+// routing tables. A peer present in more than one table is only returned once.
+func NearestPeersAcrossTables(id ID, count int, tables ...*RoutingTable) []peer.ID {
+	// the globally nearest peers are necessarily among the nearest peers of each table.
+	seen := make(map[peer.ID]struct{})
+	var candidates []peer.ID
+	for _, rt := range tables {
+		for _, p := range rt.NearestPeers(id, count) {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			candidates = append(candidates, p)
+		}
+	}
+
+	candidates = SortClosestPeers(candidates, id)
+	if count < len(candidates) {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// NearestPeersPreferConnected returns the 'count' closest peers to the given ID, letting connected peers
+// jump ahead of disconnected ones that are at a comparable distance.
+//
+// Peers are grouped into distance bands by the number of leading bits they share with the ID, and bands
+// are ordered from closest to farthest as in NearestPeers. Within a band, the peers the function set with
+// WithConnectedness reports as network.Connected come first, each half ordered by distance. A connected
+// peer can therefore displace a closer disconnected peer of the same band from the result, but never a
+// peer of a closer band. Without a connectedness function this is the same as NearestPeers.
+func (rt *RoutingTable) NearestPeersPreferConnected(id ID, count int) []peer.ID {
+	if rt.connectedness == nil {
+		return rt.NearestPeers(id, count)
+	}
+
+	// every band collectNearest touches is collected in full, so the bands
+	// the 'count' closest peers fall into are complete.
+	pds := peerDistanceSorter{
+		peers:  make([]peerDistance, 0, count+rt.bucketsize),
+		target: id,
+	}
+	rt.rlockTable()
+	rt.collectNearest(&pds, id, count)
+	rt.tabLock.RUnlock()
+	pds.sort()
+
+	type rankedPeer struct {
+		p         peer.ID
+		band      int
+		connected bool
+	}
+	ranked := make([]rankedPeer, 0, len(pds.peers))
+	for _, pd := range pds.peers {
+		ranked = append(ranked, rankedPeer{
+			p:         pd.p,
+			band:      ks.ZeroPrefixLen(pd.distance),
+			connected: rt.connectedness(pd.p) == network.Connected,
+		})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].band != ranked[j].band {
+			return ranked[i].band > ranked[j].band
+		}
+		return ranked[i].connected && !ranked[j].connected
+	})
+
+	if count < len(ranked) {
+		ranked = ranked[:count]
+	}
+	out := make([]peer.ID, 0, len(ranked))
+	for _, rp := range ranked {
+		out = append(out, rp.p)
+	}
+	return out
+}
+
+// NearestPeersUnsorted returns up to 'count' peers close to the given ID, gathered from the same buckets
+// NearestPeers looks at but without sorting them by distance. The order of the returned peers is unspecified
+// and they are not guaranteed to be the 'count' closest ones, only close-ish ones, which is cheaper to compute.
+func (rt *RoutingTable) NearestPeersUnsorted(id ID, count int) []peer.ID {
+	if count <= 0 {
+		return []peer.ID{}
+	}
+
+	pic := peerIDCollector{
+		peers: make([]peer.ID, 0, count+rt.bucketsize),
+	}
+	rt.rlockTable()
+	rt.collectNearest(&pic, id, count)
+	rt.tabLock.RUnlock()
+
+	if count < len(pic.peers) {
+		pic.peers = pic.peers[:count]
+	}
+	return pic.peers
+}
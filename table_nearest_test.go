@@ -0,0 +1,371 @@
+package kbucket
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNearestPeersIter(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	next := rt.NearestPeersIter(ConvertPeerID(local))
+	_, ok := next()
+	require.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		next := rt.NearestPeersIter(id)
+
+		// changes made after creating the iterator are not visible to it.
+		extra := test.RandPeerIDFatal(t)
+		rt.TryAddPeer(extra, true, false)
+
+		var got []peer.ID
+		for p, ok := next(); ok; p, ok = next() {
+			got = append(got, p)
+		}
+		rt.RemovePeer(extra)
+
+		require.Equal(t, SortClosestPeers(rt.ListPeers(), id), got)
+		_, ok := next()
+		require.False(t, ok)
+	}
+}
+
+func TestKthNearestPeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	_, ok := rt.KthNearestPeer(ConvertPeerID(local), 0)
+	require.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	n := rt.Size()
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		sorted := SortClosestPeers(rt.ListPeers(), id)
+		for _, k := range []int{0, 1, 5, n - 1} {
+			p, ok := rt.KthNearestPeer(id, k)
+			require.True(t, ok)
+			require.Equal(t, sorted[k], p, "k = %d", k)
+		}
+
+		_, ok := rt.KthNearestPeer(id, n)
+		require.False(t, ok)
+		_, ok = rt.KthNearestPeer(id, -1)
+		require.False(t, ok)
+	}
+}
+
+func TestFarthestPeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	_, ok := rt.FarthestPeer(ConvertPeerID(local))
+	require.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		sorted := SortClosestPeers(rt.ListPeers(), id)
+		p, ok := rt.FarthestPeer(id)
+		require.True(t, ok)
+		require.Equal(t, sorted[len(sorted)-1], p)
+	}
+}
+
+func TestNearestPeersByCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.NearestPeersByCpl(ConvertPeerID(local), 10))
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		nearest := rt.NearestPeers(id, 20)
+
+		// putting the groups back together from the highest Cpl gives the nearest peers back.
+		byCpl := rt.NearestPeersByCpl(id, 20)
+		var merged []peer.ID
+		for cpl := len(id) * 8; cpl >= 0; cpl-- {
+			for _, p := range byCpl[cpl] {
+				require.Equal(t, cpl, CommonPrefixLen(id, ConvertPeerID(p)))
+			}
+			merged = append(merged, byCpl[cpl]...)
+		}
+		require.Equal(t, nearest, merged)
+	}
+}
+
+func TestNearestPeersMulti(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	ids := make([]ID, 10)
+	for i := range ids {
+		ids[i] = ConvertPeerID(test.RandPeerIDFatal(t))
+	}
+	require.Empty(t, rt.NearestPeersMulti(nil, 10))
+
+	// both with counts for which we keep a heap and for which we sort all candidates.
+	for _, count := range []int{5, 50} {
+		nearest := rt.NearestPeersMulti(ids, count)
+		require.Len(t, nearest, len(ids))
+		for _, id := range ids {
+			require.Equal(t, rt.NearestPeers(id, count), nearest[string(id)])
+		}
+	}
+}
+
+func TestAmClosest(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.True(t, rt.AmClosest(ConvertPeerID(test.RandPeerIDFatal(t))))
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	require.True(t, rt.AmClosest(ConvertPeerID(local)))
+
+	for i := 0; i < 50; i++ {
+		target := test.RandPeerIDFatal(t)
+		nearest := rt.NearestPeers(ConvertPeerID(target), 1)
+		require.Equal(t, Closer(local, nearest[0], string(target)), rt.AmClosest(ConvertPeerID(target)))
+	}
+}
+
+func TestNearestPeersAcrossTables(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	var tables []*RoutingTable
+	var all []peer.ID
+	shared := test.RandPeerIDFatal(t)
+	for i := 0; i < 3; i++ {
+		rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+		require.NoError(t, err)
+		rt.TryAddPeer(shared, true, false)
+		for j := 0; j < 30; j++ {
+			rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+		}
+		all = append(all, rt.ListPeers()...)
+		tables = append(tables, rt)
+	}
+
+	unique := make(map[peer.ID]struct{})
+	var expected []peer.ID
+	for _, p := range all {
+		if _, ok := unique[p]; !ok {
+			unique[p] = struct{}{}
+			expected = append(expected, p)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		sorted := SortClosestPeers(expected, id)
+		require.Equal(t, sorted[:10], NearestPeersAcrossTables(id, 10, tables...))
+		require.Equal(t, sorted, NearestPeersAcrossTables(id, len(all), tables...))
+	}
+
+	require.Empty(t, NearestPeersAcrossTables(ConvertPeerID(local), 10))
+}
+
+func TestNearestPeersPreferConnected(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	connected := make(map[peer.ID]bool)
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithConnectedness(func(p peer.ID) network.Connectedness {
+			if connected[p] {
+				return network.Connected
+			}
+			return network.NotConnected
+		}))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		p := test.RandPeerIDFatal(t)
+		connected[p] = i%3 == 0
+		rt.TryAddPeer(p, true, false)
+	}
+
+	for i := 0; i < 20; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+
+		// bands closest first, connected peers first within a band, then by distance.
+		expected := SortClosestPeers(rt.ListPeers(), id)
+		sort.SliceStable(expected, func(i, j int) bool {
+			bi := CommonPrefixLen(ConvertPeerID(expected[i]), id)
+			bj := CommonPrefixLen(ConvertPeerID(expected[j]), id)
+			if bi != bj {
+				return bi > bj
+			}
+			return connected[expected[i]] && !connected[expected[j]]
+		})
+
+		for _, count := range []int{1, 5, 20, len(expected) + 1} {
+			n := count
+			if n > len(expected) {
+				n = len(expected)
+			}
+			require.Equal(t, expected[:n], rt.NearestPeersPreferConnected(id, count), "count = %d", count)
+		}
+	}
+
+	// without a connectedness function it's just NearestPeers.
+	plain, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	for p := range connected {
+		plain.TryAddPeer(p, true, false)
+	}
+	id := ConvertPeerID(test.RandPeerIDFatal(t))
+	require.Equal(t, plain.NearestPeers(id, 10), plain.NearestPeersPreferConnected(id, 10))
+
+	_, err = NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithConnectedness(nil))
+	require.Error(t, err)
+}
+
+func TestNearestPeersUnsorted(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.NearestPeersUnsorted(ConvertPeerID(local), 10))
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+
+		nearest := rt.NearestPeers(id, rt.Size())
+		got := rt.NearestPeersUnsorted(id, 10)
+		require.Len(t, got, 10)
+		require.Subset(t, nearest, got)
+
+		// none of them shares fewer bits with the ID than the 10th closest peer does.
+		minCpl := CommonPrefixLen(ConvertPeerID(nearest[9]), id)
+		for _, p := range got {
+			require.GreaterOrEqual(t, CommonPrefixLen(ConvertPeerID(p), id), minCpl)
+		}
+
+		require.ElementsMatch(t, nearest, rt.NearestPeersUnsorted(id, rt.Size()+1))
+		require.Empty(t, rt.NearestPeersUnsorted(id, 0))
+	}
+}
+
+func BenchmarkNearestPeersUnsorted(b *testing.B) {
+	b.StopTimer()
+	local := ConvertKey("localKey")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	require.NoError(b, err)
+
+	for i := 0; i < 10000; i++ {
+		tab.TryAddPeer(test.RandPeerIDFatal(b), true, false)
+	}
+	targets := make([]ID, 1000)
+	for i := range targets {
+		targets[i] = ConvertPeerID(test.RandPeerIDFatal(b))
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tab.NearestPeersUnsorted(targets[i%len(targets)], 20)
+	}
+}
+
+func TestNearestPeersEqualDistanceOrder(t *testing.T) {
+	t.Parallel()
+
+	// peers only share a distance to the target when they share a DHT ID, so the sorters are fed one directly.
+	target := ConvertKey("target")
+	dhtId := ConvertKey("shared")
+	peers := make([]peer.ID, 8)
+	for i := range peers {
+		peers[i] = test.RandPeerIDFatal(t)
+	}
+	want := append([]peer.ID(nil), peers...)
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+	for i := 0; i < 5; i++ {
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+		sorter := peerDistanceSorter{target: target}
+		pdh := peerDistanceHeap{target: target, count: 3}
+		for _, p := range peers {
+			sorter.appendPeer(p, dhtId)
+			pdh.offerPeer(p, dhtId)
+		}
+		sorter.sort()
+		var sorted, nearest []peer.ID
+		for _, pd := range sorter.peers {
+			sorted = append(sorted, pd.p)
+		}
+		for _, pd := range pdh.sorted() {
+			nearest = append(nearest, pd.p)
+		}
+		require.Equal(t, want, sorted)
+		require.Equal(t, want[:3], nearest)
+	}
+}
@@ -0,0 +1,90 @@
+package kbucket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// debouncer coalesces peer added and removed notifications into batches delivered at most once per interval.
+type debouncer struct {
+	interval time.Duration
+	notify   func(added, removed []peer.ID)
+
+	// deliverLk serializes deliveries so that batches are seen in order.
+	deliverLk sync.Mutex
+
+	mu sync.Mutex
+	// net change for each peer since the last delivery, +1 for added and -1 for removed.
+	pending map[peer.ID]int
+	timer   *time.Timer
+	closed  bool
+}
+
+func newDebouncer(interval time.Duration, notify func(added, removed []peer.ID)) *debouncer {
+	return &debouncer{
+		interval: interval,
+		notify:   notify,
+		pending:  make(map[peer.ID]int),
+	}
+}
+
+func (d *debouncer) peerAdded(p peer.ID) {
+	d.record(p, 1)
+}
+
+func (d *debouncer) peerRemoved(p peer.ID) {
+	d.record(p, -1)
+}
+
+func (d *debouncer) record(p peer.ID, delta int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.pending[p] += delta
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.interval, d.flush)
+	}
+}
+
+// flush delivers the pending notifications, if any.
+func (d *debouncer) flush() {
+	d.deliverLk.Lock()
+	defer d.deliverLk.Unlock()
+
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[peer.ID]int)
+	d.timer = nil
+	d.mu.Unlock()
+
+	// a peer that was added and removed again since the last delivery cancels out.
+	var added, removed []peer.ID
+	for p, delta := range pending {
+		switch {
+		case delta > 0:
+			added = append(added, p)
+		case delta < 0:
+			removed = append(removed, p)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		d.notify(added, removed)
+	}
+}
+
+// close delivers the notifications still pending and stops any further delivery.
+func (d *debouncer) close() {
+	d.mu.Lock()
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.mu.Unlock()
+
+	d.flush()
+}
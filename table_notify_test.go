@@ -0,0 +1,76 @@
+package kbucket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+type notificationBatch struct {
+	added, removed []peer.ID
+}
+
+func TestDebouncedNotifications(t *testing.T) {
+	t.Parallel()
+
+	var lk sync.Mutex
+	var batches []notificationBatch
+	getBatches := func() []notificationBatch {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]notificationBatch(nil), batches...)
+	}
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithDebouncedNotifications(50*time.Millisecond, func(added, removed []peer.ID) {
+			lk.Lock()
+			defer lk.Unlock()
+			batches = append(batches, notificationBatch{added, removed})
+		}))
+	require.NoError(t, err)
+
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		p := test.RandPeerIDFatal(t)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		peers = append(peers, p)
+	}
+	// added and removed again within the same batch.
+	rt.RemovePeer(peers[9])
+
+	require.Eventually(t, func() bool {
+		return len(getBatches()) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.ElementsMatch(t, peers[:9], getBatches()[0].added)
+	require.Empty(t, getBatches()[0].removed)
+
+	// whatever is pending when the table is closed is delivered right away.
+	rt.RemovePeer(peers[0])
+	require.NoError(t, rt.Close())
+	require.Len(t, getBatches(), 2)
+	require.Empty(t, getBatches()[1].added)
+	require.Equal(t, []peer.ID{peers[0]}, getBatches()[1].removed)
+
+	// nothing is delivered after that.
+	rt.RemovePeer(peers[1])
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, getBatches(), 2)
+
+	_, err = NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithDebouncedNotifications(0, func(added, removed []peer.ID) {}))
+	require.Error(t, err)
+	_, err = NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithDebouncedNotifications(time.Second, nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package kbucket
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// persistedPeer is how a peer of the Routing Table is saved to disk.
+type persistedPeer struct {
+	Id                            peer.ID   `json:"id"`
+	LastUsefulAt                  time.Time `json:"last_useful_at"`
+	LastSuccessfulOutboundQueryAt time.Time `json:"last_successful_outbound_query_at"`
+	AddedAt                       time.Time `json:"added_at"`
+	Replaceable                   bool      `json:"replaceable"`
+}
+
+// persistedTable is how the Routing Table is saved to disk.
+type persistedTable struct {
+	Peers []persistedPeer `json:"peers"`
+}
+
+// saveTo writes the peers of the Routing Table to the file at path. The file is written next to its
+// final location first and then renamed over it, so that a crash never leaves a partially written file.
+func (rt *RoutingTable) saveTo(path string) error {
+	var pt persistedTable
+	rt.rlockTable()
+	for _, b := range rt.buckets {
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*PeerInfo)
+			pt.Peers = append(pt.Peers, persistedPeer{
+				Id:                            p.Id,
+				LastUsefulAt:                  p.LastUsefulAt,
+				LastSuccessfulOutboundQueryAt: p.LastSuccessfulOutboundQueryAt,
+				AddedAt:                       p.AddedAt,
+				Replaceable:                   p.replaceable,
+			})
+		}
+	}
+	rt.tabLock.RUnlock()
+
+	data, err := json.Marshal(&pt)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadFrom adds the peers saved to the file at path by saveTo to the Routing Table, restoring their metadata.
+// The peers go through the same checks as when they are added with TryAddPeer. A missing file is not an error.
+func (rt *RoutingTable) loadFrom(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var pt persistedTable
+	if err := json.Unmarshal(data, &pt); err != nil {
+		return err
+	}
+
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	for _, pp := range pt.Peers {
+		if added, err := rt.addPeer(context.Background(), pp.Id, false, pp.Replaceable, true); !added {
+			log.Debugf("persisted peer %s not restored: %v", pp.Id, err)
+			continue
+		}
+		if pi := rt.buckets[rt.bucketIdForPeer(pp.Id)].getPeer(pp.Id); pi != nil {
+			pi.LastUsefulAt = pp.LastUsefulAt
+			pi.LastSuccessfulOutboundQueryAt = pp.LastSuccessfulOutboundQueryAt
+			pi.AddedAt = pp.AddedAt
+		}
+	}
+	return nil
+}
+
+// autoPersist periodically saves the Routing Table to the file set with WithAutoPersist,
+// until the Routing Table is closed.
+func (rt *RoutingTable) autoPersist() {
+	ticker := time.NewTicker(rt.persistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-rt.ctx.Done():
+			return
+		}
+		// don't save a table that has been closed while we were waiting.
+		if rt.ctx.Err() != nil {
+			return
+		}
+
+		if err := rt.saveTo(rt.persistPath); err != nil {
+			log.Warnf("failed to persist the routing table to %s: %s", rt.persistPath, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package kbucket
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoPersist(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	path := filepath.Join(t.TempDir(), "rt.json")
+
+	_, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithAutoPersist("", time.Second))
+	require.Error(t, err)
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithAutoPersist(path, 0))
+	require.Error(t, err)
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPersistedPeers(""))
+	require.Error(t, err)
+
+	// a missing file leaves the table empty.
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithPersistedPeers(path), WithAutoPersist(path, 10*time.Millisecond))
+	require.NoError(t, err)
+	require.Zero(t, rt.Size())
+
+	for i := 0; i < 20; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, i%2 == 0)
+	}
+	queriedAt := time.Now().Add(-time.Minute).Round(0)
+	p := rt.ListPeers()[0]
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, queriedAt))
+	want := rt.GetPeerInfos()
+
+	require.Eventually(t, func() bool {
+		restored, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPersistedPeers(path))
+		require.NoError(t, err)
+		defer restored.Close()
+		return restored.Size() == len(want)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, rt.Close())
+
+	restored, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPersistedPeers(path))
+	require.NoError(t, err)
+	defer restored.Close()
+	require.ElementsMatch(t, rt.ListPeers(), restored.ListPeers())
+	for _, pi := range restored.GetPeerInfos() {
+		if pi.Id == p {
+			require.True(t, queriedAt.Equal(pi.LastSuccessfulOutboundQueryAt))
+		}
+	}
+	restored.tabLock.RLock()
+	for _, b := range rt.buckets {
+		for _, pi := range b.peers() {
+			require.Equal(t, pi.replaceable, restored.buckets[restored.bucketIdForPeer(pi.Id)].getPeer(pi.Id).replaceable)
+		}
+	}
+	restored.tabLock.RUnlock()
+
+	// no temporary file is left behind, once a save that was in flight when the table was closed completes.
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		return len(entries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a corrupt file is not fatal.
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPersistedPeers(path))
+	require.NoError(t, err)
+	require.Zero(t, rt.Size())
+}
@@ -0,0 +1,73 @@
+//go:build prometheus
+
+package kbucket
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promSizeDesc = prometheus.NewDesc("kbucket_peers",
+		"Number of peers in the routing table.", nil, nil)
+	promBucketsDesc = prometheus.NewDesc("kbucket_buckets",
+		"Number of buckets in the routing table.", nil, nil)
+	promBucketPeersDesc = prometheus.NewDesc("kbucket_bucket_peers",
+		"Number of peers in each bucket of the routing table.", []string{"bucket"}, nil)
+	promAddedDesc = prometheus.NewDesc("kbucket_peers_added_total",
+		"Number of peers added to the routing table.", nil, nil)
+	promRemovedDesc = prometheus.NewDesc("kbucket_peers_removed_total",
+		"Number of peers removed from the routing table.", nil, nil)
+	promReplacedDesc = prometheus.NewDesc("kbucket_peers_replaced_total",
+		"Number of peers evicted to make room for a new peer.", nil, nil)
+	promRejectedDesc = prometheus.NewDesc("kbucket_peers_rejected_total",
+		"Number of peers rejected by the routing table.", []string{"reason"}, nil)
+)
+
+type prometheusCollector struct {
+	rt *RoutingTable
+}
+
+// PrometheusCollector returns a prometheus.Collector reporting the size of the Routing Table, its number of
+// buckets, the number of peers in each bucket and the lifetime Counters. The gauges are computed by scanning
+// the table under its read lock on every Collect.
+// It's only available when building with the prometheus build tag, so that the core package doesn't depend on
+// the prometheus client.
+func PrometheusCollector(rt *RoutingTable) prometheus.Collector {
+	return &prometheusCollector{rt: rt}
+}
+
+func (c *prometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promSizeDesc
+	ch <- promBucketsDesc
+	ch <- promBucketPeersDesc
+	ch <- promAddedDesc
+	ch <- promRemovedDesc
+	ch <- promReplacedDesc
+	ch <- promRejectedDesc
+}
+
+func (c *prometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.rt.rlockTable()
+	fill := make([]int, len(c.rt.buckets))
+	size := 0
+	for i, b := range c.rt.buckets {
+		fill[i] = b.len()
+		size += fill[i]
+	}
+	c.rt.tabLock.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(promSizeDesc, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(promBucketsDesc, prometheus.GaugeValue, float64(len(fill)))
+	for i, n := range fill {
+		ch <- prometheus.MustNewConstMetric(promBucketPeersDesc, prometheus.GaugeValue, float64(n), strconv.Itoa(i))
+	}
+
+	counters := c.rt.Counters()
+	ch <- prometheus.MustNewConstMetric(promAddedDesc, prometheus.CounterValue, float64(counters.Added))
+	ch <- prometheus.MustNewConstMetric(promRemovedDesc, prometheus.CounterValue, float64(counters.Removed))
+	ch <- prometheus.MustNewConstMetric(promReplacedDesc, prometheus.CounterValue, float64(counters.Replaced))
+	ch <- prometheus.MustNewConstMetric(promRejectedDesc, prometheus.CounterValue, float64(counters.RejectedHighLatency), "high_latency")
+	ch <- prometheus.MustNewConstMetric(promRejectedDesc, prometheus.CounterValue, float64(counters.RejectedNoCapacity), "no_capacity")
+}
@@ -0,0 +1,51 @@
+//go:build prometheus
+
+package kbucket
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(p, true, false)
+	rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	rt.RemovePeer(p)
+
+	c := PrometheusCollector(rt)
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP kbucket_peers Number of peers in the routing table.
+# TYPE kbucket_peers gauge
+kbucket_peers 1
+# HELP kbucket_buckets Number of buckets in the routing table.
+# TYPE kbucket_buckets gauge
+kbucket_buckets 1
+# HELP kbucket_bucket_peers Number of peers in each bucket of the routing table.
+# TYPE kbucket_bucket_peers gauge
+kbucket_bucket_peers{bucket="0"} 1
+# HELP kbucket_peers_added_total Number of peers added to the routing table.
+# TYPE kbucket_peers_added_total counter
+kbucket_peers_added_total 2
+# HELP kbucket_peers_removed_total Number of peers removed from the routing table.
+# TYPE kbucket_peers_removed_total counter
+kbucket_peers_removed_total 1
+`), "kbucket_peers", "kbucket_buckets", "kbucket_bucket_peers", "kbucket_peers_added_total", "kbucket_peers_removed_total"))
+	problems, err := testutil.CollectAndLint(c)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
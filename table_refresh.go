@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -34,6 +35,58 @@ func (rt *RoutingTable) GetTrackedCplsForRefresh() []time.Time {
 	return cpls
 }
 
+// RefreshPriorityFunc rates how urgently a Cpl needs to be refreshed, the higher the more urgent, given the
+// time since it was last refreshed, which saturates at the maximum time.Duration if it never was, and the
+// number of peers in the table with that Cpl. It's called without holding any lock of the table.
+type RefreshPriorityFunc func(cpl uint, sinceRefresh time.Duration, peers int, bucketSize int) float64
+
+// DefaultRefreshPriority is the RefreshPriorityFunc used unless set otherwise with WithRefreshPriorityFunc.
+// It's the number of seconds since the Cpl was last refreshed multiplied by one plus the number of free slots
+// its bucket would have: a full bucket weighs its staleness once, an empty one bucketSize+1 times. As a result,
+// the Cpls that were never refreshed come first, emptiest first.
+func DefaultRefreshPriority(cpl uint, sinceRefresh time.Duration, peers int, bucketSize int) float64 {
+	free := bucketSize - peers
+	if free < 0 {
+		free = 0
+	}
+	return sinceRefresh.Seconds() * float64(free+1)
+}
+
+// RefreshPriority returns the Cpls tracked for refresh, see GetTrackedCplsForRefresh, ordered from the most
+// urgent to refresh to the least, as rated by the function set with WithRefreshPriorityFunc. Cpls rated the
+// same are ordered by ascending Cpl.
+func (rt *RoutingTable) RefreshPriority() []uint {
+	maxCommonPrefix := rt.maxCommonPrefix()
+	if maxCommonPrefix > maxCplForRefresh {
+		maxCommonPrefix = maxCplForRefresh
+	}
+
+	peers := make([]int, maxCommonPrefix+1)
+	rt.rlockTable()
+	for cpl := range peers {
+		peers[cpl] = rt.nPeersForCpl(uint(cpl))
+	}
+	rt.tabLock.RUnlock()
+
+	refreshedAt := make([]time.Time, maxCommonPrefix+1)
+	rt.cplRefreshLk.RLock()
+	for cpl := range refreshedAt {
+		refreshedAt[cpl] = rt.cplRefreshedAt[uint(cpl)]
+	}
+	rt.cplRefreshLk.RUnlock()
+
+	cpls := make([]uint, maxCommonPrefix+1)
+	priorities := make([]float64, maxCommonPrefix+1)
+	for cpl := range cpls {
+		cpls[cpl] = uint(cpl)
+		priorities[cpl] = rt.refreshPriority(uint(cpl), time.Since(refreshedAt[cpl]), peers[cpl], rt.bucketsize)
+	}
+	sort.SliceStable(cpls, func(i, j int) bool {
+		return priorities[cpls[i]] > priorities[cpls[j]]
+	})
+	return cpls
+}
+
 func randUint16() (uint16, error) {
 	// Read a random prefix.
 	var prefixBytes [2]byte
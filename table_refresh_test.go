@@ -112,3 +112,43 @@ func TestRefreshAndGetTrackedCpls(t *testing.T) {
 		}
 	}
 }
+
+func TestRefreshPriority(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Equal(t, []uint{0}, rt.RefreshPriority())
+
+	// Cpl 0 is full, Cpls 1 and 2 have a free slot.
+	byCpl := make(map[uint]peer.ID)
+	for _, cpl := range []uint{0, 0, 1, 2} {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		byCpl[cpl] = p
+	}
+
+	// none of them was refreshed, so the emptiest come first.
+	require.Equal(t, []uint{1, 2, 0}, rt.RefreshPriority())
+
+	// a Cpl that was never refreshed comes before the ones that were.
+	now := time.Now()
+	rt.ResetCplRefreshedAtForID(ConvertPeerID(byCpl[1]), now.Add(-time.Hour))
+	rt.ResetCplRefreshedAtForID(ConvertPeerID(byCpl[2]), now.Add(-2*time.Hour))
+	require.Equal(t, []uint{0, 2, 1}, rt.RefreshPriority())
+
+	_, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithRefreshPriorityFunc(nil))
+	require.Error(t, err)
+	rt, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithRefreshPriorityFunc(func(cpl uint, _ time.Duration, _ int, _ int) float64 { return float64(cpl) }))
+	require.NoError(t, err)
+	for _, p := range byCpl {
+		rt.TryAddPeer(p, true, false)
+	}
+	require.Equal(t, []uint{2, 1, 0}, rt.RefreshPriority())
+}
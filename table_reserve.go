@@ -0,0 +1,143 @@
+package kbucket
+
+import (
+	"context"
+	"errors"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrPeerAlreadyPresent is returned when reserving a slot for a peer that is already in the Routing Table.
+var ErrPeerAlreadyPresent = errors.New("peer is already in the routing table")
+
+// ErrPeerAlreadyReserved is returned when reserving a slot for a peer that already has one.
+var ErrPeerAlreadyReserved = errors.New("peer already has a reservation")
+
+// ErrInvalidReservation is returned when committing a reservation that was already committed or released.
+var ErrInvalidReservation = errors.New("invalid reservation")
+
+// ReservationToken identifies a slot reserved with Reserve.
+type ReservationToken struct {
+	p   peer.ID
+	seq uint64
+}
+
+// Peer returns the peer the slot is reserved for.
+func (t ReservationToken) Peer() peer.ID {
+	return t.p
+}
+
+type reservation struct {
+	dhtId ID
+	seq   uint64
+}
+
+// Reserve holds a slot in the Routing Table for the given peer, e.g. while we dial it, so that the decision
+// to admit the peer still holds once the dial completes. The reserved slot counts against the capacity of
+// the peer's bucket and of the table, but the peer doesn't show up in the table until the reservation is
+// committed with CommitReservation. It must be either committed or released with ReleaseReservation,
+// unless the peer is added with TryAddPeer in the meantime, which uses up the reservation as a commit would.
+//
+// A slot is only reserved if the peer could be added right away without evicting another peer;
+// otherwise the error TryAddPeer would return is returned. The diversity filter is only applied on commit.
+func (rt *RoutingTable) Reserve(p peer.ID) (ReservationToken, error) {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.closed {
+		return ReservationToken{}, ErrTableClosed
+	}
+	if rt.validatePeerIDs {
+		if _, err := peer.IDFromBytes([]byte(p)); err != nil {
+			return ReservationToken{}, ErrInvalidPeerID
+		}
+	}
+	dhtId := ConvertPeerID(p)
+	bucketID := rt.bucketIdForDhtId(dhtId)
+	if rt.buckets[bucketID].getPeer(p) != nil {
+		return ReservationToken{}, ErrPeerAlreadyPresent
+	}
+	if _, ok := rt.reservations[p]; ok {
+		return ReservationToken{}, ErrPeerAlreadyReserved
+	}
+	if _, ok := rt.admissionLatency(p); !ok {
+		return ReservationToken{}, ErrPeerRejectedHighLatency
+	}
+	if rt.maxTableSize > 0 && rt.tableLoad() >= rt.maxTableSize {
+		return ReservationToken{}, ErrTableFull
+	}
+
+	if rt.occupied(bucketID) >= rt.bucketsize && bucketID == len(rt.buckets)-1 {
+		// same as when adding a peer, unfold the last bucket to try and make room.
+		rt.nextBucket()
+		bucketID = rt.bucketIdForDhtId(dhtId)
+	}
+	if rt.occupied(bucketID) >= rt.bucketsize {
+		return ReservationToken{}, ErrPeerRejectedNoCapacity
+	}
+
+	if rt.reservations == nil {
+		rt.reservations = make(map[peer.ID]reservation)
+	}
+	rt.reservationSeq++
+	rt.reservations[p] = reservation{dhtId: dhtId, seq: rt.reservationSeq}
+	return ReservationToken{p: p, seq: rt.reservationSeq}, nil
+}
+
+// CommitReservation adds the peer a slot was reserved for to the Routing Table, using the reserved slot.
+// It returns what TryAddPeer would, or ErrInvalidReservation if the reservation was already committed or released.
+func (rt *RoutingTable) CommitReservation(token ReservationToken, queryPeer bool, isReplaceable bool) (bool, error) {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if !rt.dropReservation(token) {
+		return false, ErrInvalidReservation
+	}
+	b, err := rt.addPeer(context.Background(), token.p, queryPeer, isReplaceable, true)
+	rt.countRejection(err)
+	return b, err
+}
+
+// ReleaseReservation gives up a reserved slot without adding the peer, e.g. because the dial failed.
+// Releasing a reservation that was already committed or released is a no-op.
+func (rt *RoutingTable) ReleaseReservation(token ReservationToken) {
+	rt.lockTable()
+	defer rt.unlockTable()
+
+	if rt.dropReservation(token) {
+		// the slot is free again for the adds waiting for room.
+		rt.notifyRoom()
+	}
+}
+
+// dropReservation removes the reservation the token stands for, returning false if there is none.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) dropReservation(token ReservationToken) bool {
+	r, ok := rt.reservations[token.p]
+	if !ok || r.seq != token.seq {
+		return false
+	}
+	delete(rt.reservations, token.p)
+	return true
+}
+
+// occupied returns the number of slots taken in the given bucket, by its peers and by reservations.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) occupied(bucketID int) int {
+	n := rt.buckets[bucketID].len()
+	if len(rt.reservations) == 0 {
+		return n
+	}
+	for _, r := range rt.reservations {
+		if rt.bucketIdForDhtId(r.dhtId) == bucketID {
+			n++
+		}
+	}
+	return n
+}
+
+// tableLoad returns the number of slots taken in the whole table, by its peers and by reservations.
+// locking is the responsibility of the caller
+func (rt *RoutingTable) tableLoad() int {
+	return rt.size() + len(rt.reservations)
+}
@@ -0,0 +1,119 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservations(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p1, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	p2, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+
+	// the reserved slot is taken, but the peer isn't in the table yet.
+	token, err := rt.Reserve(p1)
+	require.NoError(t, err)
+	require.Equal(t, p1, token.Peer())
+	require.Empty(t, rt.ListPeers())
+	_, err = rt.Reserve(p1)
+	require.ErrorIs(t, err, ErrPeerAlreadyReserved)
+	_, err = rt.TryAddPeer(p2, true, false)
+	require.ErrorIs(t, err, ErrPeerRejectedNoCapacity)
+	_, err = rt.Reserve(p2)
+	require.ErrorIs(t, err, ErrPeerRejectedNoCapacity)
+
+	// committing fills the reserved slot, only once.
+	b, err := rt.CommitReservation(token, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, p1, rt.Find(p1))
+	_, err = rt.CommitReservation(token, true, false)
+	require.ErrorIs(t, err, ErrInvalidReservation)
+	_, err = rt.Reserve(p1)
+	require.ErrorIs(t, err, ErrPeerAlreadyPresent)
+
+	// releasing frees the slot.
+	rt.RemovePeer(p1)
+	token, err = rt.Reserve(p2)
+	require.NoError(t, err)
+	rt.ReleaseReservation(token)
+	rt.ReleaseReservation(token)
+	_, err = rt.CommitReservation(token, true, false)
+	require.ErrorIs(t, err, ErrInvalidReservation)
+	b, err = rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestReservationUsedByTryAddPeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	other, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+
+	// a failed add leaves the reservation alone.
+	token, err := rt.Reserve(p)
+	require.NoError(t, err)
+	m.RecordLatency(p, 2*time.Hour)
+	_, err = rt.TryAddPeer(p, true, false)
+	require.ErrorIs(t, err, ErrPeerRejectedHighLatency)
+	_, err = rt.TryAddPeer(other, true, false)
+	require.ErrorIs(t, err, ErrPeerRejectedNoCapacity)
+
+	// adding the peer directly takes the slot reserved for it and uses up the reservation.
+	m.RemovePeer(p)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	_, err = rt.CommitReservation(token, true, false)
+	require.ErrorIs(t, err, ErrInvalidReservation)
+	require.Equal(t, []peer.ID{p}, rt.ListPeers())
+
+	// the slot is free again once the peer is gone.
+	rt.RemovePeer(p)
+	b, err = rt.TryAddPeer(other, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestReservationsCountTowardsMaxTableSize(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxTableSize(1))
+	require.NoError(t, err)
+
+	token, err := rt.Reserve(test.RandPeerIDFatal(t))
+	require.NoError(t, err)
+	_, err = rt.Reserve(test.RandPeerIDFatal(t))
+	require.ErrorIs(t, err, ErrTableFull)
+	_, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.ErrorIs(t, err, ErrTableFull)
+
+	rt.ReleaseReservation(token)
+	b, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+}
@@ -0,0 +1,36 @@
+package kbucket
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// ScoreFunc rates how useful a peer of the Routing Table is, the higher the better. It's called with the
+// table's read lock held, so it must not call back into the table.
+type ScoreFunc func(p PeerInfo, m peerstore.Metrics) float64
+
+// DefaultScoreFunc is the ScoreFunc used unless set otherwise with WithScoreFunc. A peer loses a point for
+// each second elapsed since it was last useful to us, or since it was added if it never was, and for each
+// millisecond of its latency EWMA.
+func DefaultScoreFunc(p PeerInfo, m peerstore.Metrics) float64 {
+	lastUseful := p.LastUsefulAt
+	if lastUseful.IsZero() {
+		lastUseful = p.AddedAt
+	}
+	return -time.Since(lastUseful).Seconds() - float64(m.LatencyEWMA(p.Id))/float64(time.Millisecond)
+}
+
+// PeerScore returns the score of the given peer, as rated by the ScoreFunc set with WithScoreFunc.
+// It returns false if the peer isn't in the Routing Table.
+func (rt *RoutingTable) PeerScore(p peer.ID) (float64, bool) {
+	rt.rlockTable()
+	defer rt.tabLock.RUnlock()
+
+	pi := rt.buckets[rt.bucketIdForPeer(p)].getPeer(p)
+	if pi == nil {
+		return 0, false
+	}
+	return rt.scoreFunc(*pi, rt.metrics), true
+}
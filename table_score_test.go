@@ -0,0 +1,48 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerScore(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	useful := test.RandPeerIDFatal(t)
+	slow := test.RandPeerIDFatal(t)
+	m.RecordLatency(slow, time.Second)
+	rt.TryAddPeer(useful, true, false)
+	rt.TryAddPeer(slow, true, false)
+	require.True(t, rt.UpdateLastUsefulAt(useful, time.Now()))
+
+	_, ok := rt.PeerScore(test.RandPeerIDFatal(t))
+	require.False(t, ok)
+	usefulScore, ok := rt.PeerScore(useful)
+	require.True(t, ok)
+	slowScore, ok := rt.PeerScore(slow)
+	require.True(t, ok)
+	require.Greater(t, usefulScore, slowScore)
+
+	_, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithScoreFunc(nil))
+	require.Error(t, err)
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithScoreFunc(func(p PeerInfo, m peerstore.Metrics) float64 {
+			return m.LatencyEWMA(p.Id).Seconds()
+		}))
+	require.NoError(t, err)
+	rt.TryAddPeer(slow, true, false)
+	score, ok := rt.PeerScore(slow)
+	require.True(t, ok)
+	require.Equal(t, 1.0, score)
+}
@@ -0,0 +1,106 @@
+package kbucket
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// tableChangeBufferSize is the number of changes buffered for each subscriber before changes get dropped.
+const tableChangeBufferSize = 256
+
+// TableChangeKind tells what happened to the peer of a TableChange.
+type TableChangeKind int
+
+const (
+	// PeerAddedChange means the peer was added to the Routing Table.
+	PeerAddedChange TableChangeKind = iota
+	// PeerRemovedChange means the peer was removed from the Routing Table.
+	PeerRemovedChange
+	// PeerUpdatedChange means the LastUsefulAt or LastSuccessfulOutboundQueryAt time of the peer was updated.
+	PeerUpdatedChange
+)
+
+// TableChange describes a change to the Routing Table, see Subscribe.
+type TableChange struct {
+	Kind TableChangeKind
+	Peer peer.ID
+	// Dropped is the number of changes that were dropped for this subscriber right before this one because
+	// its buffer was full. A non-zero value means the subscriber fell behind and missed part of the history.
+	Dropped uint64
+}
+
+type subscriber struct {
+	ch      chan TableChange
+	dropped uint64
+}
+
+// subscribers is the set of channels the changes to the table are published to.
+type subscribers struct {
+	lk     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+// add registers a new subscriber and returns its channel and a function that unregisters it.
+func (s *subscribers) add() (<-chan TableChange, func()) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	sub := &subscriber{ch: make(chan TableChange, tableChangeBufferSize)}
+	if s.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	if s.subs == nil {
+		s.subs = make(map[*subscriber]struct{})
+	}
+	s.subs[sub] = struct{}{}
+
+	return sub.ch, func() {
+		s.lk.Lock()
+		defer s.lk.Unlock()
+
+		if _, ok := s.subs[sub]; ok {
+			delete(s.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// publish sends the change to all subscribers without blocking, counting it as dropped for the ones whose
+// buffer is full.
+func (s *subscribers) publish(kind TableChangeKind, p peer.ID) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for sub := range s.subs {
+		select {
+		case sub.ch <- TableChange{Kind: kind, Peer: p, Dropped: sub.dropped}:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// close unregisters all subscribers, closing their channel.
+func (s *subscribers) close() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for sub := range s.subs {
+		close(sub.ch)
+	}
+	s.subs = nil
+	s.closed = true
+}
+
+// Subscribe returns a channel on which the changes to the Routing Table are sent, in the order they happen,
+// and a function that stops them and closes the channel. A snapshot of the table, e.g. with GetPeerInfos, taken
+// after subscribing can be kept in sync with the changes. The changes are buffered; once the buffer of a
+// subscriber is full, the new changes are dropped and counted in the Dropped field of the next change it
+// receives. The channel is closed when the table is closed.
+func (rt *RoutingTable) Subscribe() (<-chan TableChange, func()) {
+	return rt.subscribers.add()
+}
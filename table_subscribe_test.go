@@ -0,0 +1,54 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	changes, cancel := rt.Subscribe()
+	other, cancelOther := rt.Subscribe()
+
+	p := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(p, false, false)
+	require.Equal(t, TableChange{Kind: PeerAddedChange, Peer: p}, <-changes)
+	require.True(t, rt.MarkPeerUseful(p))
+	require.Equal(t, TableChange{Kind: PeerUpdatedChange, Peer: p}, <-changes)
+
+	// a subscriber that falls behind learns how many changes it missed.
+	for i := 0; i < tableChangeBufferSize+10; i++ {
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, time.Now()))
+	}
+	for i := 0; i < tableChangeBufferSize; i++ {
+		require.Equal(t, TableChange{Kind: PeerUpdatedChange, Peer: p}, <-changes)
+	}
+	rt.RemovePeer(p)
+	require.Equal(t, TableChange{Kind: PeerRemovedChange, Peer: p, Dropped: 10}, <-changes)
+
+	// unsubscribing closes the channel.
+	cancel()
+	cancel()
+	_, ok := <-changes
+	require.False(t, ok)
+
+	// so does closing the table.
+	require.NoError(t, rt.Close())
+	for range other {
+	}
+	cancelOther()
+	closed, _ := rt.Subscribe()
+	_, ok = <-closed
+	require.False(t, ok)
+}
@@ -1,10 +1,15 @@
 package kbucket
 
 import (
+	"context"
+	"math/big"
 	"math/rand"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/test"
 
@@ -223,475 +228,789 @@ func TestEmptyBucketCollapse(t *testing.T) {
 	require.NotContains(t, rt.ListPeers(), p2)
 }
 
-func TestRemovePeer(t *testing.T) {
+func TestReplacementCache(t *testing.T) {
 	t.Parallel()
-	local := test.RandPeerIDFatal(t)
 
+	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithReplacementCacheSize(2))
 	require.NoError(t, err)
 
-	p1, _ := rt.GenRandPeerID(0)
-	p2, _ := rt.GenRandPeerID(0)
-	b, err := rt.TryAddPeer(p1, true, false)
-	require.True(t, b)
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		peers = append(peers, p)
+	}
+
+	b, err := rt.TryAddPeer(peers[0], true, false)
 	require.NoError(t, err)
-	b, err = rt.TryAddPeer(p2, true, false)
 	require.True(t, b)
+	for _, p := range peers[1:] {
+		_, err := rt.TryAddPeer(p, true, false)
+		require.Equal(t, ErrPeerRejectedNoCapacity, err)
+	}
+	// only the two most recently seen candidates are kept.
+	require.Equal(t, []peer.ID{peers[3], peers[2]}, rt.ReplacementCache())
+
+	// seeing a candidate again makes it the most recent one.
+	_, err = rt.TryAddPeer(peers[2], true, false)
+	require.Equal(t, ErrPeerRejectedNoCapacity, err)
+	require.Equal(t, []peer.ID{peers[2], peers[3]}, rt.ReplacementCache())
+
+	// removing the peer promotes the most recent candidate.
+	rt.RemovePeer(peers[0])
+	require.Equal(t, []peer.ID{peers[2]}, rt.ListPeers())
+	require.Equal(t, []peer.ID{peers[3]}, rt.ReplacementCache())
+	require.NoError(t, rt.CheckInvariants())
+
+	// so does a stale peer being evicted.
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(peers[2], time.Now().Add(-time.Hour)))
+	require.Equal(t, []peer.ID{peers[2]}, rt.RemoveStalePeers(time.Minute))
+	require.Equal(t, []peer.ID{peers[3]}, rt.ListPeers())
+	require.Empty(t, rt.ReplacementCache())
+
+	// the cache is disabled by default.
+	rt, err = NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	rt.TryAddPeer(peers[0], true, false)
+	rt.TryAddPeer(peers[1], true, false)
+	require.Empty(t, rt.ReplacementCache())
 
-	// ensure p1 & p2 are in the RT
-	require.Len(t, rt.ListPeers(), 2)
-	require.Contains(t, rt.ListPeers(), p1)
-	require.Contains(t, rt.ListPeers(), p2)
+	_, err = NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithReplacementCacheSize(-1))
+	require.Error(t, err)
+}
 
-	// remove a peer and ensure it's not in the RT
-	require.NotEmpty(t, rt.Find(p1))
-	rt.RemovePeer(p1)
-	require.Empty(t, rt.Find(p1))
-	require.NotEmpty(t, rt.Find(p2))
+func TestNewRoutingTableValidation(t *testing.T) {
+	t.Parallel()
+
+	local := ConvertPeerID(test.RandPeerIDFatal(t))
+	m := pstore.NewMetrics()
+
+	_, err := NewRoutingTable(0, local, time.Hour, m, NoOpThreshold, nil)
+	require.Error(t, err)
+	_, err = NewRoutingTable(-1, local, time.Hour, m, NoOpThreshold, nil)
+	require.Error(t, err)
+	_, err = NewRoutingTable(1, local, -time.Second, m, NoOpThreshold, nil)
+	require.Error(t, err)
+	_, err = NewRoutingTable(1, local, time.Hour, nil, NoOpThreshold, nil)
+	require.Error(t, err)
+
+	rt, err := NewRoutingTable(1, local, 0, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.NoError(t, rt.Close())
 }
 
-func TestTableCallbacks(t *testing.T) {
+func TestPeerIDValidation(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
+	malformed := peer.ID("definitely not a multihash")
+
+	// anything goes by default.
 	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	b, err := rt.TryAddPeer(malformed, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
 
-	peers := make([]peer.ID, 100)
-	for i := 0; i < 100; i++ {
-		peers[i] = test.RandPeerIDFatal(t)
-	}
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithPeerIDValidation())
+	require.NoError(t, err)
+	b, err = rt.TryAddPeer(malformed, true, false)
+	require.Equal(t, ErrInvalidPeerID, err)
+	require.False(t, b)
+	_, err = rt.TryAddPeer("", true, false)
+	require.Equal(t, ErrInvalidPeerID, err)
+	require.Zero(t, rt.Size())
+	_, err = rt.Reserve("")
+	require.Equal(t, ErrInvalidPeerID, err)
 
-	pset := make(map[peer.ID]struct{})
-	rt.PeerAdded = func(p peer.ID) {
-		pset[p] = struct{}{}
-	}
-	rt.PeerRemoved = func(p peer.ID) {
-		delete(pset, p)
+	b, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestHasBucketForCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.False(t, rt.HasBucketForCpl(0))
+
+	// a second peer unfolds the wildcard bucket.
+	for cpl := uint(0); cpl < 2; cpl++ {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
 	}
+	require.True(t, rt.HasBucketForCpl(0))
+	require.False(t, rt.HasBucketForCpl(1))
+	require.False(t, rt.HasBucketForCpl(100))
+}
 
-	rt.TryAddPeer(peers[0], true, false)
-	if _, ok := pset[peers[0]]; !ok {
-		t.Fatal("should have this peer")
+func TestExpectedBucket(t *testing.T) {
+	t.Parallel()
+
+	local := ID{0x00, 0x00}
+	require.Equal(t, 0, ExpectedBucket(local, ID{0x80, 0x00}, 5))
+	require.Equal(t, 3, ExpectedBucket(local, ID{0x10, 0x00}, 5))
+	require.Equal(t, 4, ExpectedBucket(local, ID{0x01, 0x00}, 5))
+	require.Equal(t, 4, ExpectedBucket(local, local, 5))
+	require.Equal(t, 0, ExpectedBucket(local, ID{0x01, 0x00}, 1))
+	require.Equal(t, 0, ExpectedBucket(local, ID{0x01, 0x00}, 0))
+
+	// it agrees with where the table puts its peers.
+	lid := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(lid), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
 	}
 
-	rt.RemovePeer(peers[0])
-	if _, ok := pset[peers[0]]; ok {
-		t.Fatal("should not have this peer")
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+	for i, b := range rt.buckets {
+		for _, p := range b.peerIds() {
+			require.Equal(t, i, ExpectedBucket(rt.local, ConvertPeerID(p), len(rt.buckets)))
+		}
 	}
+}
 
-	for _, p := range peers {
-		rt.TryAddPeer(p, true, false)
+func TestBucketPeers(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	ps, err := rt.BucketPeers(0)
+	require.NoError(t, err)
+	require.Empty(t, ps)
+
+	for i := 0; i < 50; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
 	}
 
-	out := rt.ListPeers()
-	for _, outp := range out {
-		if _, ok := pset[outp]; !ok {
-			t.Fatal("should have peer in the peerset")
+	var all []peer.ID
+	for i := 0; ; i++ {
+		ps, err := rt.BucketPeers(i)
+		if err != nil {
+			rt.tabLock.RLock()
+			require.Equal(t, len(rt.buckets), i)
+			rt.tabLock.RUnlock()
+			break
 		}
-		delete(pset, outp)
+		for _, p := range ps {
+			rt.tabLock.RLock()
+			require.Equal(t, i, rt.bucketIdForPeer(p))
+			rt.tabLock.RUnlock()
+		}
+		all = append(all, ps...)
 	}
+	require.ElementsMatch(t, rt.ListPeers(), all)
 
-	if len(pset) > 0 {
-		t.Fatal("have peers in peerset that were not in the table", len(pset))
+	_, err = rt.BucketPeers(-1)
+	require.Error(t, err)
+}
+
+func TestCanRemovePeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var peers []peer.ID
+	for i := 0; i < 2; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		peers = append(peers, p)
 	}
+	protected := peers[0]
+	var asked []peer.ID
+	rt.CanRemovePeer = func(p peer.ID) bool {
+		asked = append(asked, p)
+		return p != protected
+	}
+
+	b, err := rt.TryAddPeer(protected, true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// the protected peer can't be removed, replaced or expired.
+	rt.RemovePeer(protected)
+	_, err = rt.TryAddPeer(peers[1], true, false)
+	require.Equal(t, ErrPeerRejectedNoCapacity, err)
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(protected, time.Now().Add(-time.Hour)))
+	require.Empty(t, rt.RemoveStalePeers(time.Minute))
+	require.Equal(t, []peer.ID{protected}, rt.ListPeers())
+	require.Equal(t, []peer.ID{protected, protected, protected}, asked)
+	require.NoError(t, rt.CheckInvariants())
+
+	// peers that aren't in the table don't go through the hook.
+	asked = nil
+	rt.RemovePeer(peers[1])
+	require.Empty(t, asked)
+
+	rt.CanRemovePeer = nil
+	rt.RemovePeer(protected)
+	require.Zero(t, rt.Size())
 }
 
-// Right now, this just makes sure that it doesnt hang or crash
-func TestTryAddPeerLoad(t *testing.T) {
+func TestPeersByAge(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
 	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	require.Empty(t, rt.PeersByAge())
+	_, ok := rt.OldestPeer()
+	require.False(t, ok)
 
-	peers := make([]peer.ID, 100)
-	for i := 0; i < 100; i++ {
-		peers[i] = test.RandPeerIDFatal(t)
+	now := time.Now()
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		p := test.RandPeerIDFatal(t)
+		rt.TryAddPeer(p, true, false)
+		peers = append(peers, p)
 	}
-
-	for i := 0; i < 10000; i++ {
-		rt.TryAddPeer(peers[rand.Intn(len(peers))], true, false)
+	// peers[i] was added i hours ago.
+	rt.tabLock.Lock()
+	for i, p := range peers {
+		rt.buckets[rt.bucketIdForPeer(p)].getPeer(p).AddedAt = now.Add(-time.Duration(i) * time.Hour)
 	}
+	rt.tabLock.Unlock()
 
-	for i := 0; i < 100; i++ {
-		id := ConvertPeerID(test.RandPeerIDFatal(t))
-		ret := rt.NearestPeers(id, 5)
-		if len(ret) == 0 {
-			t.Fatal("Failed to find node near ID.")
-		}
+	pis := rt.PeersByAge()
+	require.Len(t, pis, len(peers))
+	for i, pi := range pis {
+		require.Equal(t, peers[len(peers)-1-i], pi.Id)
 	}
+	oldest, ok := rt.OldestPeer()
+	require.True(t, ok)
+	require.Equal(t, peers[len(peers)-1], oldest.Id)
+
+	// the returned values are copies.
+	oldest.AddedAt = now
+	pis[0].AddedAt = now
+	require.Equal(t, peers[len(peers)-1], rt.PeersByAge()[0].Id)
 }
 
-func TestTableFind(t *testing.T) {
+func TestPeersByStaleness(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
 	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	require.Empty(t, rt.PeersByStaleness())
 
-	peers := make([]peer.ID, 100)
+	now := time.Now()
+	var peers []peer.ID
 	for i := 0; i < 5; i++ {
-		peers[i] = test.RandPeerIDFatal(t)
-		rt.TryAddPeer(peers[i], true, false)
+		p := test.RandPeerIDFatal(t)
+		rt.TryAddPeer(p, true, false)
+		peers = append(peers, p)
+	}
+	// peers[i] was last queried i hours ago.
+	for i, p := range peers {
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, now.Add(-time.Duration(i)*time.Hour)))
 	}
 
-	t.Logf("Searching for peer: '%s'", peers[2])
-	found := rt.NearestPeer(ConvertPeerID(peers[2]))
-	if !(found == peers[2]) {
-		t.Fatalf("Failed to lookup known node...")
+	pis := rt.PeersByStaleness()
+	require.Len(t, pis, len(peers))
+	for i, pi := range pis {
+		require.Equal(t, peers[len(peers)-1-i], pi.Id)
 	}
+
+	// the returned values are copies.
+	pis[0].LastSuccessfulOutboundQueryAt = now
+	require.Equal(t, peers[len(peers)-1], rt.PeersByStaleness()[0].Id)
 }
 
-func TestUpdateLastSuccessfulOutboundQueryAt(t *testing.T) {
+func TestConnectednessBreakdown(t *testing.T) {
+	t.Parallel()
+
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	connected := make(map[peer.ID]bool)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithConnectedness(func(p peer.ID) network.Connectedness {
+			if connected[p] {
+				return network.Connected
+			}
+			return network.CanConnect
+		}))
 	require.NoError(t, err)
 
-	p := test.RandPeerIDFatal(t)
-	b, err := rt.TryAddPeer(p, true, false)
-	require.True(t, b)
-	require.NoError(t, err)
+	c, d := rt.ConnectednessBreakdown()
+	require.Zero(t, c)
+	require.Zero(t, d)
 
-	// increment and assert
-	t2 := time.Now().Add(1 * time.Hour)
-	rt.UpdateLastSuccessfulOutboundQueryAt(p, t2)
-	rt.tabLock.Lock()
-	pi := rt.buckets[0].getPeer(p)
-	require.NotNil(t, pi)
-	require.EqualValues(t, t2, pi.LastSuccessfulOutboundQueryAt)
-	rt.tabLock.Unlock()
+	for i := 0; i < 6; i++ {
+		p := test.RandPeerIDFatal(t)
+		connected[p] = i < 2
+		rt.TryAddPeer(p, true, false)
+	}
+	c, d = rt.ConnectednessBreakdown()
+	require.Equal(t, 2, c)
+	require.Equal(t, 4, d)
+
+	plain, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	plain.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	c, d = plain.ConnectednessBreakdown()
+	require.Zero(t, c)
+	require.Equal(t, 1, d)
 }
 
-func TestUpdateLastUsefulAt(t *testing.T) {
+func TestRecentlyAddedPeers(t *testing.T) {
+	t.Parallel()
+
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
 	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
 
-	p := test.RandPeerIDFatal(t)
-	b, err := rt.TryAddPeer(p, true, false)
-	require.True(t, b)
-	require.NoError(t, err)
+	old := test.RandPeerIDFatal(t)
+	fresh := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(old, true, false)
+	rt.TryAddPeer(fresh, true, false)
 
-	// increment and assert
-	t2 := time.Now().Add(1 * time.Hour)
-	rt.UpdateLastUsefulAt(p, t2)
 	rt.tabLock.Lock()
-	pi := rt.buckets[0].getPeer(p)
-	require.NotNil(t, pi)
-	require.EqualValues(t, t2, pi.LastUsefulAt)
+	rt.buckets[rt.bucketIdForPeer(old)].getPeer(old).AddedAt = time.Now().Add(-time.Hour)
 	rt.tabLock.Unlock()
+
+	require.Equal(t, []peer.ID{fresh}, rt.RecentlyAddedPeers(time.Minute))
+	require.ElementsMatch(t, []peer.ID{old, fresh}, rt.RecentlyAddedPeers(2*time.Hour))
 }
 
-func TestTryAddPeer(t *testing.T) {
+func TestPassivePeers(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	require.Empty(t, rt.PassivePeers())
+
+	queried := test.RandPeerIDFatal(t)
+	passive1 := test.RandPeerIDFatal(t)
+	passive2 := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(queried, true, false)
+	rt.TryAddPeer(passive1, false, false)
+	rt.TryAddPeer(passive2, false, false)
+	require.ElementsMatch(t, []peer.ID{passive1, passive2}, rt.PassivePeers())
+
+	require.True(t, rt.MarkPeerUseful(passive1))
+	require.Equal(t, []peer.ID{passive2}, rt.PassivePeers())
+}
 
-	// generate 2 peers to saturate the first bucket for cpl=0
-	p1, _ := rt.GenRandPeerID(0)
-	b, err := rt.TryAddPeer(p1, true, false)
-	require.NoError(t, err)
-	require.True(t, b)
-	p2, _ := rt.GenRandPeerID(0)
-	b, err = rt.TryAddPeer(p2, true, true)
-	require.NoError(t, err)
-	require.True(t, b)
-	require.Equal(t, p1, rt.Find(p1))
-	require.Equal(t, p2, rt.Find(p2))
+func TestLatencyBiasedReplacement(t *testing.T) {
+	t.Parallel()
 
-	// trying to add a peer with cpl=0 works as p2 is replacable
-	p3, _ := rt.GenRandPeerID(0)
-	b, err = rt.TryAddPeer(p3, true, false)
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(3, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithLatencyBiasedReplacement(50*time.Millisecond))
 	require.NoError(t, err)
-	require.True(t, b)
-	require.Equal(t, p3, rt.Find(p3))
-	// p2 has been removed
-	require.Empty(t, rt.Find(p2))
 
-	// however adding peer fails as there are no more replacable peers.
-	p5, err := rt.GenRandPeerID(0)
-	require.NoError(t, err)
-	b, err = rt.TryAddPeer(p5, true, false)
-	require.Error(t, err)
-	require.False(t, b)
+	var peers []peer.ID
+	for i := 0; i < 6; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		peers = append(peers, p)
+	}
+	m.RecordLatency(peers[0], 100*time.Millisecond)
+	m.RecordLatency(peers[1], 10*time.Millisecond)
+	m.RecordLatency(peers[2], 200*time.Millisecond)
+	m.RecordLatency(peers[3], 5*time.Millisecond)
+	m.RecordLatency(peers[5], time.Millisecond)
+
+	for i, replaceable := range []bool{true, true, false} {
+		b, err := rt.TryAddPeer(peers[i], true, replaceable)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
 
-	// however, trying to add peer with cpl=1 works
-	p4, _ := rt.GenRandPeerID(1)
-	b, err = rt.TryAddPeer(p4, true, false)
+	// much faster than the slowest replaceable peer, so it takes its place rather than the one of the other
+	// replaceable peer, and never the one of the even slower irreplaceable peer.
+	b, err := rt.TryAddPeer(peers[3], true, true)
 	require.NoError(t, err)
 	require.True(t, b)
-	require.Equal(t, p4, rt.Find(p4))
+	require.ElementsMatch(t, []peer.ID{peers[1], peers[2], peers[3]}, rt.ListPeers())
 
-	// adding non query peer
-	p6, err := rt.GenRandPeerID(3)
-	require.NoError(t, err)
-	b, err = rt.TryAddPeer(p6, false, false)
+	// no latency sample, so it replaces any replaceable peer as usual.
+	b, err = rt.TryAddPeer(peers[4], true, false)
 	require.NoError(t, err)
 	require.True(t, b)
-	rt.tabLock.Lock()
-	pi := rt.buckets[rt.bucketIdForPeer(p6)].getPeer(p6)
-	require.NotNil(t, p6)
-	require.True(t, pi.LastUsefulAt.IsZero())
-	rt.tabLock.Unlock()
+	require.Contains(t, rt.ListPeers(), peers[2])
+	require.Contains(t, rt.ListPeers(), peers[4])
+
+	// irreplaceable peers are never displaced, however slow.
+	rt.MarkAllPeersIrreplaceable()
+	before := rt.ListPeers()
+	_, err = rt.TryAddPeer(peers[5], true, false)
+	require.Equal(t, ErrPeerRejectedNoCapacity, err)
+	require.ElementsMatch(t, before, rt.ListPeers())
 
+	_, err = NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithLatencyBiasedReplacement(-time.Second))
+	require.Error(t, err)
 }
 
-func TestMarkAllPeersIrreplaceable(t *testing.T) {
+func TestTryAddPeerCtx(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
 
-	// generate 2 peers
-	p1, _ := rt.GenRandPeerID(0)
-	b, err := rt.TryAddPeer(p1, true, true)
-	require.NoError(t, err)
-	require.True(t, b)
-	p2, _ := rt.GenRandPeerID(0)
-	b, err = rt.TryAddPeer(p2, true, true)
+	p := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeerCtx(context.Background(), p, true, false)
 	require.NoError(t, err)
 	require.True(t, b)
-	require.Equal(t, p1, rt.Find(p1))
-	require.Equal(t, p2, rt.Find(p2))
 
-	rt.MarkAllPeersIrreplaceable()
-	ps := rt.GetPeerInfos()
-	for i := range ps {
-		require.False(t, ps[i].replaceable)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b, err = rt.TryAddPeerCtx(ctx, test.RandPeerIDFatal(t), true, false)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, b)
 
+	// a context cancelled while waiting for the lock is honoured too.
+	ctx, cancel = context.WithCancel(context.Background())
+	rt.tabLock.Lock()
+	errCh := make(chan error)
+	go func() {
+		_, err := rt.TryAddPeerCtx(ctx, test.RandPeerIDFatal(t), true, false)
+		errCh <- err
+	}()
+	cancel()
+	rt.tabLock.Unlock()
+	require.Equal(t, context.Canceled, <-errCh)
+	require.Equal(t, 1, rt.Size())
 }
 
-func TestTableFindMultiple(t *testing.T) {
+func TestTryAddPeerBlocking(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
 
-	peers := make([]peer.ID, 100)
-	for i := 0; i < 18; i++ {
-		peers[i] = test.RandPeerIDFatal(t)
-		rt.TryAddPeer(peers[i], true, false)
-	}
+	p1, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	p2, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
 
-	t.Logf("Searching for peer: '%s'", peers[2])
-	found := rt.NearestPeers(ConvertPeerID(peers[2]), 15)
-	if len(found) != 15 {
-		t.Fatalf("Got back different number of peers than we expected.")
+	b, err := rt.TryAddPeerBlocking(context.Background(), p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// there is no room for the second peer until the first one is removed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = rt.TryAddPeerBlocking(ctx, p2, true, false)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	type result struct {
+		added bool
+		err   error
 	}
+	res := make(chan result)
+	go func() {
+		b, err := rt.TryAddPeerBlocking(context.Background(), p2, true, false)
+		res <- result{b, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	rt.RemovePeer(p1)
+
+	r := <-res
+	require.NoError(t, r.err)
+	require.True(t, r.added)
+	require.Equal(t, []peer.ID{p2}, rt.ListPeers())
+
+	// other rejections are returned right away.
+	m.RecordLatency(p1, 2*time.Hour)
+	_, err = rt.TryAddPeerBlocking(context.Background(), p1, true, false)
+	require.Equal(t, ErrPeerRejectedHighLatency, err)
 }
 
-func TestTableFindMultipleBuckets(t *testing.T) {
+func TestRebalance(t *testing.T) {
 	t.Parallel()
-
 	local := test.RandPeerIDFatal(t)
-	m := pstore.NewMetrics()
 
-	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
 
-	peers := make([]peer.ID, 100)
 	for i := 0; i < 100; i++ {
-		peers[i] = test.RandPeerIDFatal(t)
-		rt.TryAddPeer(peers[i], true, false)
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
 	}
+	peers := rt.GetPeerInfos()
 
-	closest := SortClosestPeers(rt.ListPeers(), ConvertPeerID(peers[2]))
+	// a consistent table is left untouched.
+	rt.tabLock.Lock()
+	require.NoError(t, rt.checkInvariants())
+	before := append([]*bucket(nil), rt.buckets...)
+	rt.tabLock.Unlock()
+	rt.Rebalance()
+	rt.tabLock.Lock()
+	require.Equal(t, before, rt.buckets)
+	rt.tabLock.Unlock()
 
-	t.Logf("Searching for peer: '%s'", peers[2])
+	// growing the bucket size means we have more buckets than needed.
+	rt.tabLock.Lock()
+	rt.bucketsize = 10
+	nBuckets := len(rt.buckets)
+	// and a misplaced peer makes the structure inconsistent.
+	misplaced := rt.buckets[0].list.Remove(rt.buckets[0].list.Front())
+	rt.buckets[len(rt.buckets)-1].list.PushBack(misplaced)
+	require.Error(t, rt.checkInvariants())
+	rt.tabLock.Unlock()
 
-	// should be able to find at least 30
-	// ~31 (logtwo(100) * 5)
-	found := rt.NearestPeers(ConvertPeerID(peers[2]), 20)
-	if len(found) != 20 {
-		t.Fatalf("asked for 20 peers, got %d", len(found))
-	}
-	for i, p := range found {
-		if p != closest[i] {
-			t.Fatalf("unexpected peer %d", i)
-		}
-	}
+	rt.Rebalance()
 
-	// Ok, now let's try finding all of them.
-	found = rt.NearestPeers(ConvertPeerID(peers[2]), 100)
-	if len(found) != rt.Size() {
-		t.Fatalf("asked for %d peers, got %d", rt.Size(), len(found))
-	}
+	rt.tabLock.Lock()
+	require.NoError(t, rt.checkInvariants())
+	require.Less(t, len(rt.buckets), nBuckets)
+	rt.tabLock.Unlock()
 
-	for i, p := range found {
-		if p != closest[i] {
-			t.Fatalf("unexpected peer %d", i)
-		}
-	}
+	// all peers are still there with their metadata.
+	require.ElementsMatch(t, peers, rt.GetPeerInfos())
 }
 
-// Looks for race conditions in table operations. For a more 'certain'
-// test, increase the loop counter from 1000 to a much higher number
-// and set GOMAXPROCS above 1
-func TestTableMultithreaded(t *testing.T) {
+func TestRebalanceMovesPeers(t *testing.T) {
 	t.Parallel()
+	local := test.RandPeerIDFatal(t)
 
-	local := peer.ID("localPeer")
 	m := pstore.NewMetrics()
-	tab, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
-	var peers []peer.ID
-	for i := 0; i < 500; i++ {
-		peers = append(peers, test.RandPeerIDFatal(t))
-	}
 
-	done := make(chan struct{})
-	go func() {
-		for i := 0; i < 1000; i++ {
-			n := rand.Intn(len(peers))
-			tab.TryAddPeer(peers[n], true, false)
+	// all peers fit in the single wildcard bucket.
+	byCpl := make([][]peer.ID, 3)
+	for cpl := range byCpl {
+		for i := 0; i < 3; i++ {
+			p, err := rt.GenRandPeerID(uint(cpl))
+			require.NoError(t, err)
+			b, err := rt.TryAddPeer(p, true, false)
+			require.NoError(t, err)
+			require.True(t, b)
+			byCpl[cpl] = append(byCpl[cpl], p)
 		}
-		done <- struct{}{}
-	}()
+	}
+	peers := rt.GetPeerInfos()
+	rt.tabLock.Lock()
+	require.Len(t, rt.buckets, 1)
+	// shrinking the bucket size makes it overflow.
+	rt.bucketsize = 2
+	require.Error(t, rt.checkInvariants())
+	rt.tabLock.Unlock()
 
-	go func() {
-		for i := 0; i < 1000; i++ {
-			n := rand.Intn(len(peers))
-			tab.TryAddPeer(peers[n], true, false)
-		}
-		done <- struct{}{}
-	}()
+	rt.Rebalance()
 
-	go func() {
-		for i := 0; i < 1000; i++ {
-			n := rand.Intn(len(peers))
-			tab.Find(peers[n])
-		}
-		done <- struct{}{}
-	}()
-	<-done
-	<-done
-	<-done
+	// the wildcard bucket was unfolded, moving the peers to the bucket of their Cpl.
+	for cpl, ps := range byCpl {
+		bps, err := rt.BucketPeers(cpl)
+		require.NoError(t, err)
+		require.ElementsMatch(t, ps, bps)
+	}
+	_, err = rt.BucketPeers(len(byCpl))
+	require.Error(t, err)
+	require.ElementsMatch(t, peers, rt.GetPeerInfos())
 }
 
-type mockPeerGroupFilter struct {
-	peerAddressFunc func(p peer.ID) []ma.Multiaddr
-	allowFnc        func(g peerdiversity.PeerGroupInfo) bool
+func TestNextBucketDepthGuard(t *testing.T) {
+	t.Parallel()
 
-	incrementFnc func(g peerdiversity.PeerGroupInfo)
-	decrementFnc func(p peerdiversity.PeerGroupInfo)
-}
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
 
-func (m *mockPeerGroupFilter) Allow(g peerdiversity.PeerGroupInfo) (allow bool) {
-	return m.allowFnc(g)
-}
+	// a zero bucket size makes every bucket overflow, so splitting only stops at the guard.
+	rt.tabLock.Lock()
+	rt.bucketsize = 0
+	rt.tabLock.Unlock()
 
-func (m *mockPeerGroupFilter) PeerAddresses(p peer.ID) []ma.Multiaddr {
-	return m.peerAddressFunc(p)
-}
+	_, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.Equal(t, ErrPeerRejectedNoCapacity, err)
 
-func (m *mockPeerGroupFilter) Increment(g peerdiversity.PeerGroupInfo) {
-	if m.incrementFnc != nil {
-		m.incrementFnc(g)
-	}
+	rt.tabLock.RLock()
+	require.Equal(t, len(rt.local)*8+1, len(rt.buckets))
+	rt.tabLock.RUnlock()
 }
 
-func (m *mockPeerGroupFilter) Decrement(g peerdiversity.PeerGroupInfo) {
-	if m.decrementFnc != nil {
-		m.decrementFnc(g)
+func TestMaxBucketUnfolds(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	_, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxBucketUnfolds(-1))
+	require.Error(t, err)
+
+	for _, maxUnfolds := range []int{0, 1} {
+		rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxBucketUnfolds(maxUnfolds))
+		require.NoError(t, err)
+
+		// the first two peers share a long prefix with us and fill the only bucket.
+		p1, _ := rt.GenRandPeerID(5)
+		p2, _ := rt.GenRandPeerID(5)
+		p3, _ := rt.GenRandPeerID(3)
+		for _, p := range []peer.ID{p1, p2} {
+			b, err := rt.TryAddPeer(p, true, false)
+			require.NoError(t, err)
+			require.True(t, b)
+		}
+
+		attempts := 0
+		for {
+			attempts++
+			b, err := rt.TryAddPeer(p3, true, false)
+			if err == nil {
+				require.True(t, b)
+				break
+			}
+			require.Equal(t, ErrPeerRejectedNoCapacity, err)
+		}
+		if maxUnfolds == 0 {
+			// unfolded until p1 and p2 got their own bucket.
+			require.Equal(t, 1, attempts)
+			require.Equal(t, 7, rt.MaxDepthReached())
+		} else {
+			// each add unfolds one bucket, until cpl 3 got its own bucket.
+			require.Equal(t, 4, attempts)
+			require.Equal(t, 5, rt.MaxDepthReached())
+		}
+		require.NoError(t, rt.CheckInvariants())
 	}
 }
 
-func TestDiversityFiltering(t *testing.T) {
+func TestSplitHistory(t *testing.T) {
+	t.Parallel()
 	local := test.RandPeerIDFatal(t)
-	cplCount := make(map[int]int)
-	mg := &mockPeerGroupFilter{}
-	mg.peerAddressFunc = func(p peer.ID) []ma.Multiaddr {
-		return []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/0")}
-	}
-	mg.allowFnc = func(g peerdiversity.PeerGroupInfo) bool {
-		return cplCount[g.Cpl] < 1
+
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.SplitHistory())
+
+	start := time.Now()
+	for cpl := uint(0); cpl < 4; cpl++ {
+		p, _ := rt.GenRandPeerID(cpl)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
 	}
 
-	mg.incrementFnc = func(g peerdiversity.PeerGroupInfo) {
-		cplCount[g.Cpl] = cplCount[g.Cpl] + 1
+	history := rt.SplitHistory()
+	require.Len(t, history, 3)
+	for i, ev := range history {
+		require.Equal(t, i+1, ev.Bucket)
+		require.False(t, ev.At.Before(start))
 	}
 
-	mg.decrementFnc = func(g peerdiversity.PeerGroupInfo) {
-		cplCount[g.Cpl] = cplCount[g.Cpl] - 1
+	// the history is bounded and keeps the most recent splits in order.
+	rt.tabLock.Lock()
+	for i := 0; i < splitHistorySize; i++ {
+		rt.recordSplit(SplitEvent{Bucket: 100 + i})
+	}
+	rt.tabLock.Unlock()
+	history = rt.SplitHistory()
+	require.Len(t, history, splitHistorySize)
+	for i, ev := range history {
+		require.Equal(t, 100+i, ev.Bucket)
 	}
+}
 
-	df, err := peerdiversity.NewFilter(mg, "appname", func(p peer.ID) int {
-		return CommonPrefixLen(ConvertPeerID(local), ConvertPeerID(p))
-	})
-	require.NoError(t, err)
+func TestRemovePeer(t *testing.T) {
+	t.Parallel()
+	local := test.RandPeerIDFatal(t)
 
-	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, pstore.NewMetrics(), NoOpThreshold, df)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
-	p, _ := rt.GenRandPeerID(2)
-	b, err := rt.TryAddPeer(p, true, false)
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.True(t, b)
 	require.NoError(t, err)
+	b, err = rt.TryAddPeer(p2, true, false)
 	require.True(t, b)
+	require.NoError(t, err)
 
-	p2, _ := rt.GenRandPeerID(2)
-	b, err = rt.TryAddPeer(p2, true, false)
-	require.Error(t, err)
-	require.False(t, b)
+	// ensure p1 & p2 are in the RT
+	require.Len(t, rt.ListPeers(), 2)
+	require.Contains(t, rt.ListPeers(), p1)
+	require.Contains(t, rt.ListPeers(), p2)
 
-	rt.RemovePeer(p)
-	b, err = rt.TryAddPeer(p2, true, false)
-	require.NoError(t, err)
-	require.True(t, b)
+	// remove a peer and ensure it's not in the RT
+	require.NotEmpty(t, rt.Find(p1))
+	rt.RemovePeer(p1)
+	require.Empty(t, rt.Find(p1))
+	require.NotEmpty(t, rt.Find(p2))
 }
 
-func TestGetPeerInfos(t *testing.T) {
+func TestRemoveStalePeers(t *testing.T) {
+	t.Parallel()
 	local := test.RandPeerIDFatal(t)
+
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+	var removed []peer.ID
+	rt.PeerRemoved = func(p peer.ID) {
+		removed = append(removed, p)
+	}
 
-	require.Empty(t, rt.GetPeerInfos())
-
-	p1 := test.RandPeerIDFatal(t)
-	p2 := test.RandPeerIDFatal(t)
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(1)
+	p3, _ := rt.GenRandPeerID(2)
+	for _, p := range []peer.ID{p1, p2, p3} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
 
-	b, err := rt.TryAddPeer(p1, false, false)
-	require.True(t, b)
-	require.NoError(t, err)
-	b, err = rt.TryAddPeer(p2, true, false)
-	require.True(t, b)
-	require.NoError(t, err)
+	// nothing is stale yet
+	require.Empty(t, rt.RemoveStalePeers(time.Hour))
+	require.Len(t, rt.ListPeers(), 3)
 
-	ps := rt.GetPeerInfos()
-	require.Len(t, ps, 2)
-	ms := make(map[peer.ID]PeerInfo)
-	for _, p := range ps {
-		ms[p.Id] = p
-	}
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p1, time.Now().Add(-2*time.Hour)))
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p3, time.Now().Add(-3*time.Hour)))
 
-	require.Equal(t, p1, ms[p1].Id)
-	require.True(t, ms[p1].LastUsefulAt.IsZero())
-	require.Equal(t, p2, ms[p2].Id)
-	require.False(t, ms[p2].LastUsefulAt.IsZero())
+	stale := rt.RemoveStalePeers(time.Hour)
+	require.ElementsMatch(t, []peer.ID{p1, p3}, stale)
+	require.ElementsMatch(t, []peer.ID{p1, p3}, removed)
+	require.Equal(t, []peer.ID{p2}, rt.ListPeers())
 }
 
-func TestPeerRemovedNotificationWhenPeerIsEvicted(t *testing.T) {
+func TestTableCallbacks(t *testing.T) {
 	t.Parallel()
 
 	local := test.RandPeerIDFatal(t)
 	m := pstore.NewMetrics()
-	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
 	require.NoError(t, err)
+
+	peers := make([]peer.ID, 100)
+	for i := 0; i < 100; i++ {
+		peers[i] = test.RandPeerIDFatal(t)
+	}
+
 	pset := make(map[peer.ID]struct{})
 	rt.PeerAdded = func(p peer.ID) {
 		pset[p] = struct{}{}
@@ -700,20 +1019,1199 @@ func TestPeerRemovedNotificationWhenPeerIsEvicted(t *testing.T) {
 		delete(pset, p)
 	}
 
-	p1, _ := rt.GenRandPeerID(0)
-	p2, _ := rt.GenRandPeerID(0)
+	rt.TryAddPeer(peers[0], true, false)
+	if _, ok := pset[peers[0]]; !ok {
+		t.Fatal("should have this peer")
+	}
 
-	// first peer works
-	b, err := rt.TryAddPeer(p1, true, false)
-	require.NoError(t, err)
-	require.True(t, b)
+	rt.RemovePeer(peers[0])
+	if _, ok := pset[peers[0]]; ok {
+		t.Fatal("should not have this peer")
+	}
 
-	// second is rejected because of capacity
-	b, err = rt.TryAddPeer(p2, true, false)
-	require.False(t, b)
-	require.Error(t, err)
+	for _, p := range peers {
+		rt.TryAddPeer(p, true, false)
+	}
 
-	// pset has first peer
+	out := rt.ListPeers()
+	for _, outp := range out {
+		if _, ok := pset[outp]; !ok {
+			t.Fatal("should have peer in the peerset")
+		}
+		delete(pset, outp)
+	}
+
+	if len(pset) > 0 {
+		t.Fatal("have peers in peerset that were not in the table", len(pset))
+	}
+}
+
+func TestCallbacksCanCallIntoTable(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	// the callbacks fire once the lock has been released, so they can read and even modify the table.
+	var sizes []int
+	rt.PeerAdded = func(p peer.ID) {
+		sizes = append(sizes, rt.Size())
+	}
+	rt.PeerRemoved = func(p peer.ID) {
+		sizes = append(sizes, rt.Size())
+	}
+	var populated []uint
+	rt.CplPopulated = func(cpl uint) {
+		populated = append(populated, cpl)
+		require.Equal(t, 1, rt.NPeersForCpl(cpl))
+	}
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rt.TryAddPeer(p1, true, false)
+		rt.TryAddPeer(p2, true, false)
+		rt.RemovePeer(p1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callbacks deadlocked")
+	}
+	require.Equal(t, []int{1, 2, 1}, sizes)
+	require.Equal(t, []uint{0, 1}, populated)
+
+	rt.CplPopulated = func(uint) {}
+	rt.PeerAdded = func(p peer.ID) {
+		rt.RemovePeer(p)
+	}
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Empty(t, rt.Find(p1))
+}
+
+func TestNilCallbacks(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	rt.PeerAdded = nil
+	rt.PeerRemoved = nil
+	rt.CplPopulated = nil
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+	p3, _ := rt.GenRandPeerID(1)
+	require.NotPanics(t, func() {
+		b, err := rt.TryAddPeer(p1, true, true)
+		require.NoError(t, err)
+		require.True(t, b)
+		// replaces p1.
+		b, err = rt.TryAddPeer(p2, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		b, err = rt.TryAddPeer(p3, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		rt.RemovePeer(p2)
+		require.Len(t, rt.RemoveStalePeers(0), 1)
+	})
+	require.Zero(t, rt.Size())
+}
+
+func TestCplPopulated(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var populated []uint
+	rt.CplPopulated = func(cpl uint) {
+		populated = append(populated, cpl)
+	}
+
+	// the first peer with a cpl populates it, even in the wildcard bucket.
+	p1, _ := rt.GenRandPeerID(3)
+	p2, _ := rt.GenRandPeerID(3)
+	p3, _ := rt.GenRandPeerID(1)
+	p4, _ := rt.GenRandPeerID(0)
+	for _, p := range []peer.ID{p1, p2, p3, p4} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, []uint{3, 1, 0}, populated)
+
+	// emptying a cpl and adding to it again populates it again.
+	rt.RemovePeer(p3)
+	populated = nil
+	p5, _ := rt.GenRandPeerID(1)
+	b, err := rt.TryAddPeer(p5, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []uint{1}, populated)
+}
+
+func TestCplPopulatedOnReplacement(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	for _, opts := range [][]Option{
+		// replaced in its full bucket...
+		nil,
+		// ...or evicted from the full table.
+		{WithMaxTableSize(1), WithTableFullPolicy(EvictStalestWhenFull)},
+	} {
+		rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, opts...)
+		require.NoError(t, err)
+
+		var populated []uint
+		rt.CplPopulated = func(cpl uint) {
+			populated = append(populated, cpl)
+		}
+
+		// a peer taking the place of the only peer with its Cpl doesn't populate the Cpl again.
+		p1, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		p2, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		for _, p := range []peer.ID{p1, p2} {
+			b, err := rt.TryAddPeer(p, true, true)
+			require.NoError(t, err)
+			require.True(t, b)
+		}
+		require.Equal(t, []peer.ID{p2}, rt.ListPeers())
+		require.Equal(t, []uint{0}, populated)
+	}
+
+	// but one taking the place of a peer with another Cpl does.
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithMaxTableSize(1), WithTableFullPolicy(EvictStalestWhenFull))
+	require.NoError(t, err)
+	var populated []uint
+	rt.CplPopulated = func(cpl uint) {
+		populated = append(populated, cpl)
+	}
+	for cpl := uint(0); cpl < 2; cpl++ {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, true)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, 1, rt.Size())
+	require.Equal(t, []uint{0, 1}, populated)
+}
+
+// Right now, this just makes sure that it doesnt hang or crash
+func TestTryAddPeerLoad(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	peers := make([]peer.ID, 100)
+	for i := 0; i < 100; i++ {
+		peers[i] = test.RandPeerIDFatal(t)
+	}
+
+	for i := 0; i < 10000; i++ {
+		rt.TryAddPeer(peers[rand.Intn(len(peers))], true, false)
+	}
+
+	for i := 0; i < 100; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		ret := rt.NearestPeers(id, 5)
+		if len(ret) == 0 {
+			t.Fatal("Failed to find node near ID.")
+		}
+	}
+}
+
+func TestTableFind(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	peers := make([]peer.ID, 100)
+	for i := 0; i < 5; i++ {
+		peers[i] = test.RandPeerIDFatal(t)
+		rt.TryAddPeer(peers[i], true, false)
+	}
+
+	t.Logf("Searching for peer: '%s'", peers[2])
+	found := rt.NearestPeer(ConvertPeerID(peers[2]))
+	if !(found == peers[2]) {
+		t.Fatalf("Failed to lookup known node...")
+	}
+}
+
+func TestUpdateLastSuccessfulOutboundQueryAt(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.True(t, b)
+	require.NoError(t, err)
+
+	// increment and assert
+	t2 := time.Now().Add(1 * time.Hour)
+	rt.UpdateLastSuccessfulOutboundQueryAt(p, t2)
+	rt.tabLock.Lock()
+	pi := rt.buckets[0].getPeer(p)
+	require.NotNil(t, pi)
+	require.EqualValues(t, t2, pi.LastSuccessfulOutboundQueryAt)
+	rt.tabLock.Unlock()
+}
+
+func TestUpdateLastUsefulAt(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.True(t, b)
+	require.NoError(t, err)
+
+	// increment and assert
+	t2 := time.Now().Add(1 * time.Hour)
+	rt.UpdateLastUsefulAt(p, t2)
+	rt.tabLock.Lock()
+	pi := rt.buckets[0].getPeer(p)
+	require.NotNil(t, pi)
+	require.EqualValues(t, t2, pi.LastUsefulAt)
+	rt.tabLock.Unlock()
+}
+
+func TestMarkPeerUseful(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p := test.RandPeerIDFatal(t)
+	require.False(t, rt.MarkPeerUseful(p))
+
+	b, err := rt.TryAddPeer(p, false, false)
+	require.True(t, b)
+	require.NoError(t, err)
+
+	before := time.Now()
+	require.True(t, rt.MarkPeerUseful(p))
+	rt.tabLock.Lock()
+	pi := rt.buckets[0].getPeer(p)
+	require.NotNil(t, pi)
+	require.False(t, pi.LastUsefulAt.Before(before))
+	require.False(t, pi.LastSuccessfulOutboundQueryAt.Before(before))
+	rt.tabLock.Unlock()
+}
+
+func TestMarkPeerUsefulSparesFromEviction(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithMaxTableSize(3), WithTableFullPolicy(EvictStalestWhenFull))
+	require.NoError(t, err)
+
+	var removed []peer.ID
+	rt.PeerRemoved = func(p peer.ID) { removed = append(removed, p) }
+
+	// peers[i] was last queried i+1 hours ago.
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		p := test.RandPeerIDFatal(t)
+		rt.TryAddPeer(p, true, true)
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, time.Now().Add(-time.Duration(i+1)*time.Hour)))
+		peers = append(peers, p)
+	}
+
+	// the stalest peer was just useful, so the next stalest one makes room for a new peer.
+	require.True(t, rt.MarkPeerUseful(peers[2]))
+	b, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []peer.ID{peers[1]}, removed)
+}
+
+func TestTryAddPeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	// generate 2 peers to saturate the first bucket for cpl=0
+	p1, _ := rt.GenRandPeerID(0)
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	p2, _ := rt.GenRandPeerID(0)
+	b, err = rt.TryAddPeer(p2, true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, p1, rt.Find(p1))
+	require.Equal(t, p2, rt.Find(p2))
+
+	// trying to add a peer with cpl=0 works as p2 is replacable
+	p3, _ := rt.GenRandPeerID(0)
+	b, err = rt.TryAddPeer(p3, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, p3, rt.Find(p3))
+	// p2 has been removed
+	require.Empty(t, rt.Find(p2))
+
+	// however adding peer fails as there are no more replacable peers.
+	p5, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	b, err = rt.TryAddPeer(p5, true, false)
+	require.Error(t, err)
+	require.False(t, b)
+
+	// however, trying to add peer with cpl=1 works
+	p4, _ := rt.GenRandPeerID(1)
+	b, err = rt.TryAddPeer(p4, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, p4, rt.Find(p4))
+
+	// adding non query peer
+	p6, err := rt.GenRandPeerID(3)
+	require.NoError(t, err)
+	b, err = rt.TryAddPeer(p6, false, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	rt.tabLock.Lock()
+	pi := rt.buckets[rt.bucketIdForPeer(p6)].getPeer(p6)
+	require.NotNil(t, p6)
+	require.True(t, pi.LastUsefulAt.IsZero())
+	rt.tabLock.Unlock()
+
+}
+
+func TestMaxTableSize(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxTableSize(10))
+	require.NoError(t, err)
+
+	full := 0
+	for i := 0; i < 200; i++ {
+		_, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+		if err == ErrTableFull {
+			full++
+		}
+		require.LessOrEqual(t, rt.Size(), 10)
+	}
+	require.Equal(t, 10, rt.Size())
+	require.NotZero(t, full)
+
+	// the split of the wildcard bucket respects the cap as well.
+	rt, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxTableSize(2))
+	require.NoError(t, err)
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+	p3, _ := rt.GenRandPeerID(1)
+	for _, p := range []peer.ID{p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	b, err := rt.TryAddPeer(p3, true, false)
+	require.Equal(t, ErrTableFull, err)
+	require.False(t, b)
+	require.ElementsMatch(t, []peer.ID{p1, p2}, rt.ListPeers())
+}
+
+func TestMaxTableSizeEvictByScore(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	_, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithCompositeEvictionWeights(CompositeEvictionWeights{Staleness: -1}))
+	require.Error(t, err)
+
+	// slowStale is both slow and stale, stalest is the stalest but fast, fresh is fresh and fast.
+	slowStale := test.RandPeerIDFatal(t)
+	stalest := test.RandPeerIDFatal(t)
+	fresh := test.RandPeerIDFatal(t)
+	m.RecordLatency(slowStale, 500*time.Millisecond)
+	m.RecordLatency(stalest, time.Millisecond)
+	m.RecordLatency(fresh, time.Millisecond)
+
+	for _, tc := range []struct {
+		weights CompositeEvictionWeights
+		victim  peer.ID
+	}{
+		{DefaultCompositeEvictionWeights, stalest},
+		{CompositeEvictionWeights{Staleness: 1, Latency: 100}, slowStale},
+		{CompositeEvictionWeights{Latency: 1}, slowStale},
+	} {
+		rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+			WithMaxTableSize(3), WithTableFullPolicy(EvictByScoreWhenFull), WithCompositeEvictionWeights(tc.weights))
+		require.NoError(t, err)
+		for _, p := range []peer.ID{slowStale, stalest, fresh} {
+			b, err := rt.TryAddPeer(p, true, true)
+			require.NoError(t, err)
+			require.True(t, b)
+		}
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(slowStale, time.Now().Add(-time.Hour)))
+		require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(stalest, time.Now().Add(-2*time.Hour)))
+
+		var removed []peer.ID
+		rt.PeerRemoved = func(p peer.ID) {
+			removed = append(removed, p)
+		}
+		b, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		require.Equal(t, []peer.ID{tc.victim}, removed)
+		require.Equal(t, 3, rt.Size())
+
+		// irreplaceable peers are never evicted, whatever their score.
+		rt.MarkAllPeersIrreplaceable()
+		removed = nil
+		_, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, true)
+		require.Equal(t, ErrTableFull, err)
+		require.Empty(t, removed)
+		require.Equal(t, 3, rt.Size())
+	}
+}
+
+func TestMaxTableSizeEvictStalest(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	// the buckets never fill up, so that peers are only evicted because the table is full.
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithMaxTableSize(10), WithTableFullPolicy(EvictStalestWhenFull))
+	require.NoError(t, err)
+
+	var removed []peer.ID
+	rt.PeerRemoved = func(p peer.ID) {
+		removed = append(removed, p)
+	}
+
+	for i := 0; i < 200; i++ {
+		_, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, true)
+		require.NotEqual(t, ErrTableFull, err)
+		require.LessOrEqual(t, rt.Size(), 10)
+	}
+	require.Equal(t, 10, rt.Size())
+
+	// make one of the peers the stalest one and check it's the one evicted.
+	stalest := rt.ListPeers()[3]
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(stalest, time.Now().Add(-time.Hour)))
+	removed = nil
+	b, err := rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []peer.ID{stalest}, removed)
+	require.NotContains(t, rt.ListPeers(), stalest)
+	require.Equal(t, 10, rt.Size())
+
+	// irreplaceable peers are never evicted, however stale.
+	rt.MarkAllPeersIrreplaceable()
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(rt.ListPeers()[0], time.Now().Add(-time.Hour)))
+	removed = nil
+	_, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, true)
+	require.Equal(t, ErrTableFull, err)
+	require.Empty(t, removed)
+	require.Equal(t, 10, rt.Size())
+
+	_, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxTableSize(-1))
+	require.Error(t, err)
+	_, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithTableFullPolicy(TableFullPolicy(42)))
+	require.Error(t, err)
+}
+
+func TestMarkAllPeersIrreplaceable(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	// generate 2 peers
+	p1, _ := rt.GenRandPeerID(0)
+	b, err := rt.TryAddPeer(p1, true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	p2, _ := rt.GenRandPeerID(0)
+	b, err = rt.TryAddPeer(p2, true, true)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, p1, rt.Find(p1))
+	require.Equal(t, p2, rt.Find(p2))
+
+	rt.MarkAllPeersIrreplaceable()
+	ps := rt.GetPeerInfos()
+	for i := range ps {
+		require.False(t, ps[i].replaceable)
+	}
+
+}
+
+func TestTableFindMultiple(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	peers := make([]peer.ID, 100)
+	for i := 0; i < 18; i++ {
+		peers[i] = test.RandPeerIDFatal(t)
+		rt.TryAddPeer(peers[i], true, false)
+	}
+
+	t.Logf("Searching for peer: '%s'", peers[2])
+	found := rt.NearestPeers(ConvertPeerID(peers[2]), 15)
+	if len(found) != 15 {
+		t.Fatalf("Got back different number of peers than we expected.")
+	}
+}
+
+func TestTableFindMultipleBuckets(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	peers := make([]peer.ID, 100)
+	for i := 0; i < 100; i++ {
+		peers[i] = test.RandPeerIDFatal(t)
+		rt.TryAddPeer(peers[i], true, false)
+	}
+
+	closest := SortClosestPeers(rt.ListPeers(), ConvertPeerID(peers[2]))
+
+	t.Logf("Searching for peer: '%s'", peers[2])
+
+	// should be able to find at least 30
+	// ~31 (logtwo(100) * 5)
+	found := rt.NearestPeers(ConvertPeerID(peers[2]), 20)
+	if len(found) != 20 {
+		t.Fatalf("asked for 20 peers, got %d", len(found))
+	}
+	for i, p := range found {
+		if p != closest[i] {
+			t.Fatalf("unexpected peer %d", i)
+		}
+	}
+
+	// Ok, now let's try finding all of them.
+	found = rt.NearestPeers(ConvertPeerID(peers[2]), 100)
+	if len(found) != rt.Size() {
+		t.Fatalf("asked for %d peers, got %d", rt.Size(), len(found))
+	}
+
+	for i, p := range found {
+		if p != closest[i] {
+			t.Fatalf("unexpected peer %d", i)
+		}
+	}
+}
+
+func TestNearestPeersHeapMatchesSort(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 20; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		for _, count := range []int{0, 1, 3, 10, 20, 500} {
+			require.Equal(t, rt.nearestPeers(id, count, false, nil), rt.nearestPeers(id, count, true, nil))
+		}
+	}
+}
+
+func TestNearestPeersExcluding(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	for i := 0; i < 20; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		sorted := SortClosestPeers(rt.ListPeers(), id)
+		require.Equal(t, rt.NearestPeers(id, 10), rt.NearestPeersExcluding(id, 10, nil))
+
+		// excluding the closest peers pushes the search further away.
+		exclude := make(map[peer.ID]struct{})
+		for _, p := range sorted[:15] {
+			exclude[p] = struct{}{}
+		}
+		require.Equal(t, sorted[15:20], rt.NearestPeersExcluding(id, 5, exclude))
+		require.Equal(t, sorted[15:45], rt.NearestPeersExcluding(id, 30, exclude))
+		require.Equal(t, sorted[15:], rt.NearestPeersExcluding(id, len(sorted), exclude))
+	}
+}
+
+func TestNearestPeersSupporting(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	// only every other peer speaks the protocol.
+	supporting := make(map[peer.ID]bool)
+	for i := 0; i < 200; i++ {
+		p := test.RandPeerIDFatal(t)
+		if b, _ := rt.TryAddPeer(p, true, false); b {
+			supporting[p] = i%2 == 0
+		}
+	}
+	supports := func(p peer.ID) bool { return supporting[p] }
+
+	var peers []peer.ID
+	for p, ok := range supporting {
+		if ok {
+			peers = append(peers, p)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		sorted := SortClosestPeers(peers, id)
+		require.Equal(t, sorted[:5], rt.NearestPeersSupporting(id, 5, supports))
+		require.Equal(t, sorted[:20], rt.NearestPeersSupporting(id, 20, supports))
+		require.Equal(t, sorted, rt.NearestPeersSupporting(id, len(supporting), supports))
+	}
+	require.Empty(t, rt.NearestPeersSupporting(ConvertPeerID(local), 10, func(peer.ID) bool { return false }))
+}
+
+func TestPeersWithPrefix(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	require.ElementsMatch(t, rt.ListPeers(), rt.PeersWithPrefix(nil, 0))
+
+	for _, bits := range []int{1, 3, 8, 11} {
+		prefix := ConvertPeerID(test.RandPeerIDFatal(t))
+		var expected []peer.ID
+		for _, p := range rt.ListPeers() {
+			if CommonPrefixLen(ConvertPeerID(p), prefix) >= bits {
+				expected = append(expected, p)
+			}
+		}
+		require.ElementsMatch(t, expected, rt.PeersWithPrefix(prefix, bits), "bits = %d", bits)
+	}
+}
+
+func TestPeersByRealCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.PeersByRealCpl())
+
+	// both peers end up in the single wildcard bucket.
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(3)
+	for _, p := range []peer.ID{p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, map[uint][]peer.ID{0: {p1}, 3: {p2}}, rt.PeersByRealCpl())
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	n := 0
+	for cpl, peers := range rt.PeersByRealCpl() {
+		require.Len(t, peers, rt.NPeersForCpl(cpl))
+		for _, p := range peers {
+			require.Equal(t, int(cpl), CommonPrefixLen(ConvertPeerID(local), ConvertPeerID(p)))
+		}
+		n += len(peers)
+	}
+	require.Equal(t, rt.Size(), n)
+}
+
+func TestMaxPairwiseCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	a, b, cpl := rt.MaxPairwiseCpl()
+	require.Empty(t, a)
+	require.Empty(t, b)
+	require.Zero(t, cpl)
+
+	for i := 0; i < 100; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	// compare against all pairs.
+	peers := rt.ListPeers()
+	want := 0
+	for i := range peers {
+		for j := i + 1; j < len(peers); j++ {
+			if c := CommonPrefixLen(ConvertPeerID(peers[i]), ConvertPeerID(peers[j])); c > want {
+				want = c
+			}
+		}
+	}
+	a, b, cpl = rt.MaxPairwiseCpl()
+	require.Equal(t, want, cpl)
+	require.NotEqual(t, a, b)
+	require.Equal(t, cpl, CommonPrefixLen(ConvertPeerID(a), ConvertPeerID(b)))
+	require.Equal(t, a, rt.Find(a))
+	require.Equal(t, b, rt.Find(b))
+}
+
+func TestPeersWithinDistance(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	key := ConvertPeerID(test.RandPeerIDFatal(t))
+	require.Empty(t, rt.PeersWithinDistance(key, Distance(key, ConvertKey("far"))))
+	require.NotNil(t, rt.PeersWithinDistance(key, big.NewInt(0)))
+
+	for i := 0; i < 50; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	closest := SortClosestPeers(rt.ListPeers(), key)
+
+	// a radius equal to the distance of the 5th closest peer includes exactly 5 peers.
+	radius := Distance(key, ConvertPeerID(closest[4]))
+	require.Equal(t, closest[:5], rt.PeersWithinDistance(key, radius))
+
+	// a radius just short of it excludes the 5th peer.
+	radius.Sub(radius, big.NewInt(1))
+	require.Equal(t, closest[:4], rt.PeersWithinDistance(key, radius))
+
+	require.Empty(t, rt.PeersWithinDistance(key, big.NewInt(0)))
+}
+
+func TestPeerDistance(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	a := test.RandPeerIDFatal(t)
+	b := test.RandPeerIDFatal(t)
+	require.Equal(t, Distance(ConvertPeerID(a), ConvertPeerID(b)), rt.PeerDistance(a, b))
+	require.Equal(t, rt.PeerDistance(a, b), rt.PeerDistance(b, a))
+	require.Zero(t, rt.PeerDistance(a, a).Sign())
+}
+
+func TestRankOf(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+
+	key := ConvertPeerID(test.RandPeerIDFatal(t))
+	for i, p := range SortClosestPeers(rt.ListPeers(), key) {
+		rank, ok := rt.RankOf(key, p)
+		require.True(t, ok)
+		require.Equal(t, i, rank)
+
+		rank, ok = rt.PeerRank(p, key)
+		require.True(t, ok)
+		require.Equal(t, i, rank)
+	}
+
+	_, ok := rt.RankOf(key, test.RandPeerIDFatal(t))
+	require.False(t, ok)
+	_, ok = rt.PeerRank(test.RandPeerIDFatal(t), key)
+	require.False(t, ok)
+}
+
+func TestWeightedRandomPeer(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithRandSource(rand.NewSource(1)))
+	require.NoError(t, err)
+
+	_, ok := rt.WeightedRandomPeer(func(PeerInfo) float64 { return 1 })
+	require.False(t, ok)
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	p3 := test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{p1, p2, p3} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	weights := map[peer.ID]float64{p1: 1, p2: 3, p3: 0}
+	weight := func(pi PeerInfo) float64 { return weights[pi.Id] }
+
+	picked := make(map[peer.ID]int)
+	for i := 0; i < 4000; i++ {
+		p, ok := rt.WeightedRandomPeer(weight)
+		require.True(t, ok)
+		picked[p]++
+	}
+	require.Zero(t, picked[p3])
+	require.InDelta(t, 1000, picked[p1], 150)
+	require.InDelta(t, 3000, picked[p2], 150)
+
+	_, ok = rt.WeightedRandomPeer(func(PeerInfo) float64 { return 0 })
+	require.False(t, ok)
+}
+
+// Looks for race conditions in table operations. For a more 'certain'
+// test, increase the loop counter from 1000 to a much higher number
+// and set GOMAXPROCS above 1
+func TestTableMultithreaded(t *testing.T) {
+	t.Parallel()
+
+	local := peer.ID("localPeer")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	var peers []peer.ID
+	for i := 0; i < 500; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			n := rand.Intn(len(peers))
+			tab.TryAddPeer(peers[n], true, false)
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			n := rand.Intn(len(peers))
+			tab.TryAddPeer(peers[n], true, false)
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			n := rand.Intn(len(peers))
+			tab.Find(peers[n])
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	<-done
+}
+
+func TestConcurrentDuplicateAdds(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var peers []peer.ID
+	for i := 0; i < 50; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	var wg sync.WaitGroup
+	added := make([]int, len(peers))
+	var addedLk sync.Mutex
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, p := range peers {
+				ok, _ := rt.TryAddPeer(p, true, false)
+				if ok {
+					addedLk.Lock()
+					added[i]++
+					addedLk.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, rt.CheckInvariants())
+	for i, n := range added {
+		require.LessOrEqual(t, n, 1, "peer %d reported as added more than once", i)
+	}
+	require.Equal(t, len(rt.ListPeers()), rt.Size())
+}
+
+type mockPeerGroupFilter struct {
+	peerAddressFunc func(p peer.ID) []ma.Multiaddr
+	allowFnc        func(g peerdiversity.PeerGroupInfo) bool
+
+	incrementFnc func(g peerdiversity.PeerGroupInfo)
+	decrementFnc func(p peerdiversity.PeerGroupInfo)
+}
+
+func (m *mockPeerGroupFilter) Allow(g peerdiversity.PeerGroupInfo) (allow bool) {
+	return m.allowFnc(g)
+}
+
+func (m *mockPeerGroupFilter) PeerAddresses(p peer.ID) []ma.Multiaddr {
+	return m.peerAddressFunc(p)
+}
+
+func (m *mockPeerGroupFilter) Increment(g peerdiversity.PeerGroupInfo) {
+	if m.incrementFnc != nil {
+		m.incrementFnc(g)
+	}
+}
+
+func (m *mockPeerGroupFilter) Decrement(g peerdiversity.PeerGroupInfo) {
+	if m.decrementFnc != nil {
+		m.decrementFnc(g)
+	}
+}
+
+func TestDiversityFiltering(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	cplCount := make(map[int]int)
+	mg := &mockPeerGroupFilter{}
+	mg.peerAddressFunc = func(p peer.ID) []ma.Multiaddr {
+		return []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/0")}
+	}
+	mg.allowFnc = func(g peerdiversity.PeerGroupInfo) bool {
+		return cplCount[g.Cpl] < 1
+	}
+
+	mg.incrementFnc = func(g peerdiversity.PeerGroupInfo) {
+		cplCount[g.Cpl] = cplCount[g.Cpl] + 1
+	}
+
+	mg.decrementFnc = func(g peerdiversity.PeerGroupInfo) {
+		cplCount[g.Cpl] = cplCount[g.Cpl] - 1
+	}
+
+	df, err := peerdiversity.NewFilter(mg, "appname", func(p peer.ID) int {
+		return CommonPrefixLen(ConvertPeerID(local), ConvertPeerID(p))
+	})
+	require.NoError(t, err)
+
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, pstore.NewMetrics(), NoOpThreshold, df)
+	require.NoError(t, err)
+	p, _ := rt.GenRandPeerID(2)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	p2, _ := rt.GenRandPeerID(2)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.Error(t, err)
+	require.False(t, b)
+
+	rt.RemovePeer(p)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestEnforceDiversity(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.EnforceDiversity())
+
+	// the quota allows up to limit peers per Cpl.
+	limit := 3
+	cplCount := make(map[int]int)
+	mg := &mockPeerGroupFilter{}
+	mg.peerAddressFunc = func(p peer.ID) []ma.Multiaddr {
+		return []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/0")}
+	}
+	mg.allowFnc = func(g peerdiversity.PeerGroupInfo) bool {
+		return cplCount[g.Cpl] < limit
+	}
+	mg.incrementFnc = func(g peerdiversity.PeerGroupInfo) {
+		cplCount[g.Cpl] = cplCount[g.Cpl] + 1
+	}
+	mg.decrementFnc = func(g peerdiversity.PeerGroupInfo) {
+		cplCount[g.Cpl] = cplCount[g.Cpl] - 1
+	}
+	df, err := peerdiversity.NewFilter(mg, "appname", func(p peer.ID) int {
+		return CommonPrefixLen(ConvertPeerID(local), ConvertPeerID(p))
+	})
+	require.NoError(t, err)
+
+	rt, err = NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, df)
+	require.NoError(t, err)
+	peers := make([]peer.ID, limit)
+	for i := range peers {
+		peers[i], _ = rt.GenRandPeerID(2)
+		b, err := rt.TryAddPeer(peers[i], true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		// make sure the peers have distinct AddedAt.
+		time.Sleep(time.Millisecond)
+	}
+	require.Empty(t, rt.EnforceDiversity())
+	require.Equal(t, limit, rt.Size())
+
+	// with a tighter quota, the most recently added peers go...
+	limit = 2
+	require.Equal(t, []peer.ID{peers[2]}, rt.EnforceDiversity())
+	require.ElementsMatch(t, peers[:2], rt.ListPeers())
+	require.Equal(t, 2, cplCount[2])
+
+	// ...unless they are protected.
+	limit = 1
+	rt.CanRemovePeer = func(p peer.ID) bool { return p != peers[1] }
+	require.Equal(t, []peer.ID{peers[0]}, rt.EnforceDiversity())
+	require.Equal(t, []peer.ID{peers[1]}, rt.ListPeers())
+	require.Equal(t, 1, cplCount[2])
+
+	// protected peers over the quota still count towards it, so they leave no room for unprotected ones.
+	limit = 3
+	for i := 0; i < 2; i++ {
+		p, _ := rt.GenRandPeerID(2)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		peers = append(peers, p)
+	}
+	limit = 1
+	rt.CanRemovePeer = func(p peer.ID) bool { return p != peers[1] && p != peers[3] }
+	require.Equal(t, []peer.ID{peers[4]}, rt.EnforceDiversity())
+	require.ElementsMatch(t, []peer.ID{peers[1], peers[3]}, rt.ListPeers())
+	require.Equal(t, 2, cplCount[2])
+}
+
+func TestGetPeerInfos(t *testing.T) {
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	require.Empty(t, rt.GetPeerInfos())
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+
+	b, err := rt.TryAddPeer(p1, false, false)
+	require.True(t, b)
+	require.NoError(t, err)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.True(t, b)
+	require.NoError(t, err)
+
+	ps := rt.GetPeerInfos()
+	require.Len(t, ps, 2)
+	ms := make(map[peer.ID]PeerInfo)
+	for _, p := range ps {
+		ms[p.Id] = p
+	}
+
+	require.Equal(t, p1, ms[p1].Id)
+	require.True(t, ms[p1].LastUsefulAt.IsZero())
+	require.Equal(t, p2, ms[p2].Id)
+	require.False(t, ms[p2].LastUsefulAt.IsZero())
+}
+
+func TestPeerRemovedNotificationWhenPeerIsEvicted(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	pset := make(map[peer.ID]struct{})
+	rt.PeerAdded = func(p peer.ID) {
+		pset[p] = struct{}{}
+	}
+	rt.PeerRemoved = func(p peer.ID) {
+		delete(pset, p)
+	}
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+
+	// first peer works
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// second is rejected because of capacity
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.False(t, b)
+	require.Error(t, err)
+
+	// pset has first peer
 	require.Contains(t, pset, p1)
 	require.NotContains(t, pset, p2)
 
@@ -724,18 +2222,119 @@ func TestPeerRemovedNotificationWhenPeerIsEvicted(t *testing.T) {
 	rt.tabLock.Unlock()
 	bucket.getPeer(p1).replaceable = true
 
-	b, err = rt.TryAddPeer(p2, true, false)
-	require.NoError(t, err)
-	require.True(t, b)
-	require.Contains(t, pset, p2)
-	require.NotContains(t, pset, p1)
+	b, err = rt.TryAddPeer(p2, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Contains(t, pset, p2)
+	require.NotContains(t, pset, p1)
+}
+
+func BenchmarkAddPeer(b *testing.B) {
+	b.StopTimer()
+	local := ConvertKey("localKey")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	require.NoError(b, err)
+
+	var peers []peer.ID
+	for i := 0; i < b.N; i++ {
+		peers = append(peers, test.RandPeerIDFatal(b))
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tab.TryAddPeer(peers[i], true, false)
+	}
+}
+
+func benchmarkNearestPeers(b *testing.B, useHeap bool) {
+	b.StopTimer()
+	local := ConvertKey("localKey")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	require.NoError(b, err)
+
+	for i := 0; i < 10000; i++ {
+		tab.TryAddPeer(test.RandPeerIDFatal(b), true, false)
+	}
+	targets := make([]ID, 1000)
+	for i := range targets {
+		targets[i] = ConvertPeerID(test.RandPeerIDFatal(b))
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tab.nearestPeers(targets[i%len(targets)], 3, useHeap, nil)
+	}
+}
+
+func BenchmarkNearestPeersSort(b *testing.B) {
+	benchmarkNearestPeers(b, false)
+}
+
+func BenchmarkNearestPeersHeap(b *testing.B) {
+	benchmarkNearestPeers(b, true)
+}
+
+// BenchmarkNearestPeersConcurrentAdds measures NearestPeers throughput while another
+// goroutine keeps adding and removing peers, i.e. while queries contend with writers for the table lock.
+func BenchmarkNearestPeersConcurrentAdds(b *testing.B) {
+	b.StopTimer()
+	local := ConvertKey("localKey")
+	m := pstore.NewMetrics()
+	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	require.NoError(b, err)
+
+	for i := 0; i < 10000; i++ {
+		tab.TryAddPeer(test.RandPeerIDFatal(b), true, false)
+	}
+	targets := make([]ID, 1000)
+	for i := range targets {
+		targets[i] = ConvertPeerID(test.RandPeerIDFatal(b))
+	}
+	churn := make([]peer.ID, 1000)
+	for i := range churn {
+		churn[i] = test.RandPeerIDFatal(b)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p := churn[i%len(churn)]
+			if i/len(churn)%2 == 0 {
+				tab.TryAddPeer(p, true, false)
+			} else {
+				tab.RemovePeer(p)
+			}
+		}
+	}()
+
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			tab.NearestPeers(targets[i%len(targets)], 20)
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
 }
 
-func BenchmarkAddPeer(b *testing.B) {
+// BenchmarkAddPeerReplaceable exercises the split and replacement paths of TryAddPeer,
+// as every peer is replaceable and the buckets are small.
+func BenchmarkAddPeerReplaceable(b *testing.B) {
 	b.StopTimer()
 	local := ConvertKey("localKey")
 	m := pstore.NewMetrics()
-	tab, err := NewRoutingTable(20, local, time.Hour, m, NoOpThreshold, nil)
+	tab, err := NewRoutingTable(2, local, time.Hour, m, NoOpThreshold, nil)
 	require.NoError(b, err)
 
 	var peers []peer.ID
@@ -745,7 +2344,7 @@ func BenchmarkAddPeer(b *testing.B) {
 
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		tab.TryAddPeer(peers[i], true, false)
+		tab.TryAddPeer(peers[i], true, true)
 	}
 }
 
@@ -767,3 +2366,540 @@ func BenchmarkFinds(b *testing.B) {
 		tab.Find(peers[i])
 	}
 }
+
+func TestPeersPage(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(5, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 40; i++ {
+		rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	}
+	all := rt.GetPeerInfos()
+
+	// the pages put together are the whole table, in the GetPeerInfos order.
+	var paged []PeerInfo
+	for offset := 0; offset < len(all); offset += 7 {
+		page, total := rt.PeersPage(offset, 7)
+		require.Equal(t, len(all), total)
+		require.NotEmpty(t, page)
+		require.LessOrEqual(t, len(page), 7)
+		paged = append(paged, page...)
+	}
+	require.Equal(t, all, paged)
+
+	page, total := rt.PeersPage(len(all), 7)
+	require.Empty(t, page)
+	require.Equal(t, len(all), total)
+	page, _ = rt.PeersPage(0, 0)
+	require.Empty(t, page)
+	page, _ = rt.PeersPage(-1, len(all)+10)
+	require.Equal(t, all, page)
+}
+
+func TestIsReadyForLookup(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.False(t, rt.IsReadyForLookup(0))
+
+	// a close peer alone doesn't help lookups for far keys.
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(1)
+	p3, _ := rt.GenRandPeerID(1)
+	p4, _ := rt.GenRandPeerID(2)
+	for _, p := range []peer.ID{p2, p3, p4} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.True(t, rt.HasBucketForCpl(1))
+	require.False(t, rt.IsReadyForLookup(1))
+
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.True(t, rt.IsReadyForLookup(4))
+	require.False(t, rt.IsReadyForLookup(5))
+}
+
+func TestBucketLatencies(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{0}, rt.BucketLatencies())
+
+	// bucket 0 holds a peer without latency sample, bucket 1 a peer with one.
+	unmeasured, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	measured, err := rt.GenRandPeerID(1)
+	require.NoError(t, err)
+	m.RecordLatency(measured, 20*time.Millisecond)
+	for _, p := range []peer.ID{unmeasured, measured} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, []time.Duration{0, m.LatencyEWMA(measured)}, rt.BucketLatencies())
+}
+
+func TestOccupiedBucketsBitmap(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00}, rt.OccupiedBucketsBitmap())
+	require.Empty(t, ParseOccupiedBucketsBitmap(rt.OccupiedBucketsBitmap()))
+
+	// peers in buckets 0, 2 and 9, leaving the others empty.
+	for _, cpl := range []uint{0, 2, 9, 10} {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, 11, len(rt.buckets))
+	require.Equal(t, []byte{0xa0, 0x60}, rt.OccupiedBucketsBitmap())
+	require.Equal(t, []int{0, 2, 9, 10}, ParseOccupiedBucketsBitmap(rt.OccupiedBucketsBitmap()))
+	require.Equal(t, []int{7, 8}, ParseOccupiedBucketsBitmap([]byte{0x01, 0x80}))
+}
+
+func TestMaxDepthReached(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, rt.MaxDepthReached())
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(4)
+	for _, p := range []peer.ID{p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	rt.tabLock.Lock()
+	require.Len(t, rt.buckets, 2)
+	rt.tabLock.Unlock()
+	require.Equal(t, 2, rt.MaxDepthReached())
+
+	// the maximum survives the buckets being collapsed.
+	rt.RemovePeer(p2)
+	rt.RemovePeer(p1)
+	rt.tabLock.Lock()
+	require.Len(t, rt.buckets, 1)
+	rt.tabLock.Unlock()
+	require.Equal(t, 2, rt.MaxDepthReached())
+}
+
+func TestKeyspaceCoverage(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Zero(t, rt.KeyspaceCoverage())
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(4)
+	for _, p := range []peer.ID{p1, p2} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, 1.0, rt.KeyspaceCoverage())
+
+	// the buckets left after a collapse are measured against the deepest the table has been.
+	rt.RemovePeer(p2)
+	require.Equal(t, 0.5, rt.KeyspaceCoverage())
+}
+
+func TestBucketMates(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+	p3, _ := rt.GenRandPeerID(1)
+	require.Nil(t, rt.BucketMates(p1))
+
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.NotNil(t, rt.BucketMates(p1))
+	require.Empty(t, rt.BucketMates(p1))
+
+	for _, p := range []peer.ID{p2, p3} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.Equal(t, []peer.ID{p2}, rt.BucketMates(p1))
+	require.Equal(t, []peer.ID{p1}, rt.BucketMates(p2))
+	require.Empty(t, rt.BucketMates(p3))
+}
+
+func TestClearBucket(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	require.Empty(t, rt.ClearBucket(0))
+	require.Nil(t, rt.ClearBucket(1))
+	require.Nil(t, rt.ClearBucket(-1))
+
+	p1, _ := rt.GenRandPeerID(0)
+	p2, _ := rt.GenRandPeerID(0)
+	p3, _ := rt.GenRandPeerID(1)
+	p4, _ := rt.GenRandPeerID(1)
+	p5, _ := rt.GenRandPeerID(2)
+	for _, p := range []peer.ID{p1, p2, p3, p4, p5} {
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	rt.tabLock.RLock()
+	require.Len(t, rt.buckets, 3)
+	rt.tabLock.RUnlock()
+
+	var removed []peer.ID
+	rt.PeerRemoved = func(p peer.ID) {
+		removed = append(removed, p)
+	}
+	rt.CanRemovePeer = func(p peer.ID) bool { return p != p4 }
+	require.ElementsMatch(t, []peer.ID{p1, p2}, rt.ClearBucket(0))
+	require.ElementsMatch(t, []peer.ID{p1, p2}, removed)
+	require.Equal(t, 0, rt.NPeersForCpl(0))
+
+	// protected peers are kept.
+	require.Equal(t, []peer.ID{p3}, rt.ClearBucket(1))
+	require.Equal(t, []peer.ID{p5}, rt.ClearBucket(2))
+	require.Equal(t, []peer.ID{p4}, rt.ListPeers())
+	// the empty buckets collapsed back into a single one.
+	rt.tabLock.RLock()
+	require.Len(t, rt.buckets, 1)
+	rt.tabLock.RUnlock()
+	require.NoError(t, rt.CheckInvariants())
+}
+
+func TestSetPeers(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var removed []peer.ID
+	rt.PeerRemoved = func(p peer.ID) { removed = append(removed, p) }
+
+	kept := test.RandPeerIDFatal(t)
+	gone := test.RandPeerIDFatal(t)
+	rt.TryAddPeer(kept, true, false)
+	rt.TryAddPeer(gone, false, true)
+	queriedAt := time.Now().Add(-time.Minute).Round(0)
+	require.True(t, rt.UpdateLastSuccessfulOutboundQueryAt(kept, queriedAt))
+
+	fresh := test.RandPeerIDFatal(t)
+	res := rt.SetPeers([]peer.ID{kept, fresh, fresh})
+	require.Equal(t, SetResult{Added: 1, Removed: 1, Kept: 1}, res)
+	require.ElementsMatch(t, []peer.ID{kept, fresh}, rt.ListPeers())
+	require.Equal(t, []peer.ID{gone}, removed)
+	for _, pi := range rt.GetPeerInfos() {
+		if pi.Id == kept {
+			require.True(t, queriedAt.Equal(pi.LastSuccessfulOutboundQueryAt))
+			require.False(t, pi.LastUsefulAt.IsZero())
+		}
+	}
+
+	res = rt.SetPeers(nil)
+	require.Equal(t, SetResult{Removed: 2}, res)
+	require.Zero(t, rt.Size())
+}
+
+func TestSetPeersFullBuckets(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var added, removed int
+	rt.PeerAdded = func(peer.ID) { added++ }
+	rt.PeerRemoved = func(peer.ID) { removed++ }
+
+	// the Cpl 0 bucket only has room for the first two peers with that Cpl in the new set.
+	var peers, cpl0 []peer.ID
+	for i := 0; i < 3; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		cpl0 = append(cpl0, p)
+		peers = append(peers, p)
+	}
+	for i := 0; i < 200; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+
+	res := rt.SetPeers(peers)
+	require.Equal(t, rt.Size(), res.Added+res.Kept)
+	require.Equal(t, len(peers), res.Added+res.Kept+res.Rejected)
+	require.Equal(t, res.Added, added)
+	require.Zero(t, removed)
+	require.Equal(t, cpl0[:2], rt.NearestPeers(ConvertPeerID(cpl0[0]), 2))
+	require.Zero(t, rt.Counters().Replaced)
+
+	// setting the same peers again keeps the ones already in the table.
+	size := rt.Size()
+	res = rt.SetPeers(peers)
+	require.Equal(t, SetResult{Kept: size, Rejected: len(peers) - size}, res)
+	require.Equal(t, size, rt.Size())
+	require.Zero(t, removed)
+}
+
+func TestHasCapacityAtCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithMaxTableSize(5))
+	require.NoError(t, err)
+	require.True(t, rt.HasCapacityAtCpl(0))
+
+	// the only bucket is full of peers with Cpl 0, splitting it only makes room for the other Cpls.
+	for i := 0; i < 2; i++ {
+		p, err := rt.GenRandPeerID(0)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+	}
+	require.False(t, rt.HasCapacityAtCpl(0))
+	require.True(t, rt.HasCapacityAtCpl(1))
+
+	// a replaceable peer can be evicted.
+	p, err := rt.GenRandPeerID(1)
+	require.NoError(t, err)
+	rt.TryAddPeer(p, true, true)
+	require.Equal(t, 2, len(rt.buckets))
+	p, err = rt.GenRandPeerID(1)
+	require.NoError(t, err)
+	rt.TryAddPeer(p, true, false)
+	require.True(t, rt.HasCapacityAtCpl(1))
+
+	// no peer can be added to a full table.
+	p, err = rt.GenRandPeerID(2)
+	require.NoError(t, err)
+	rt.TryAddPeer(p, true, false)
+	require.Equal(t, 5, rt.Size())
+	require.False(t, rt.HasCapacityAtCpl(3))
+}
+
+func TestClosedTable(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(1, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	p, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	b, err := rt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	// give the peer a bucket of its own, so that it can be misplaced later on.
+	rt.tabLock.Lock()
+	rt.buckets = append(rt.buckets, rt.buckets[0].split(0, rt.local))
+	rt.tabLock.Unlock()
+
+	// an add waiting for room gives up when the table is closed.
+	other, err := rt.GenRandPeerID(0)
+	require.NoError(t, err)
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := rt.TryAddPeerBlocking(context.Background(), other, true, false)
+		blocked <- err
+	}()
+
+	require.NoError(t, rt.Close())
+	require.NoError(t, rt.Close())
+	require.ErrorIs(t, <-blocked, ErrTableClosed)
+
+	_, err = rt.TryAddPeer(test.RandPeerIDFatal(t), true, false)
+	require.ErrorIs(t, err, ErrTableClosed)
+	_, err = rt.Reserve(test.RandPeerIDFatal(t))
+	require.ErrorIs(t, err, ErrTableClosed)
+
+	// removals and other changes do nothing and reads still work.
+	rt.tabLock.Lock()
+	rt.buckets[0].getPeer(p).replaceable = true
+	before := *rt.buckets[0].getPeer(p)
+	rt.tabLock.Unlock()
+	rt.RemovePeer(p)
+	require.Empty(t, rt.ClearBucket(0))
+	require.Equal(t, SetResult{}, rt.SetPeers(nil))
+	require.False(t, rt.UpdateLastSuccessfulOutboundQueryAt(p, time.Time{}))
+	require.False(t, rt.UpdateLastUsefulAt(p, time.Time{}))
+	require.False(t, rt.MarkPeerUseful(p))
+	rt.MarkAllPeersIrreplaceable()
+	rt.ApplyLivenessResults(map[peer.ID]error{p: nil})
+	// a misplaced peer makes the table inconsistent, which rebalancing would fix by moving it back.
+	rt.tabLock.Lock()
+	rt.buckets[1].list.PushBack(rt.buckets[0].list.Remove(rt.buckets[0].list.Front()))
+	rt.tabLock.Unlock()
+	rt.Rebalance()
+	rt.SplitToCpl(5)
+	rt.tabLock.Lock()
+	require.Len(t, rt.buckets, 2)
+	require.Equal(t, before, *rt.buckets[1].getPeer(p))
+	rt.buckets[0].list.PushBack(rt.buckets[1].list.Remove(rt.buckets[1].list.Front()))
+	rt.tabLock.Unlock()
+	require.Equal(t, []peer.ID{p}, rt.ListPeers())
+	require.Equal(t, p, rt.Find(p))
+}
+
+func TestInitialBuckets(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	_, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithInitialBuckets(0))
+	require.Error(t, err)
+	_, err = NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithInitialBuckets(258))
+	require.Error(t, err)
+
+	// fill a table to save.
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+	for cpl := uint(0); cpl < 8; cpl++ {
+		for i := 0; i < 2; i++ {
+			p, err := rt.GenRandPeerID(cpl)
+			require.NoError(t, err)
+			rt.TryAddPeer(p, true, false)
+		}
+	}
+	require.NotEmpty(t, rt.SplitHistory())
+	path := filepath.Join(t.TempDir(), "rt.json")
+	require.NoError(t, rt.saveTo(path))
+
+	// restoring it into a deep enough table doesn't split any bucket.
+	restored, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil,
+		WithInitialBuckets(rt.MaxDepthReached()), WithPersistedPeers(path))
+	require.NoError(t, err)
+	require.Empty(t, restored.SplitHistory())
+	require.NoError(t, restored.CheckInvariants())
+	require.ElementsMatch(t, rt.ListPeers(), restored.ListPeers())
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		require.Equal(t, rt.NearestPeers(id, 5), restored.NearestPeers(id, 5))
+	}
+
+	// an empty pre-deepened table works like any other.
+	empty, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil, WithInitialBuckets(4))
+	require.NoError(t, err)
+	require.Empty(t, empty.NearestPeers(ConvertPeerID(local), 5))
+	p, err := empty.GenRandPeerID(6)
+	require.NoError(t, err)
+	b, err := empty.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.NoError(t, empty.CheckInvariants())
+	require.Equal(t, []peer.ID{p}, empty.NearestPeers(ConvertPeerID(local), 5))
+}
+
+func TestDropInvalidPeers(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	others := make([]peer.ID, 0, 5)
+	for i := 0; i < 5; i++ {
+		p := test.RandPeerIDFatal(t)
+		rt.TryAddPeer(p, true, false)
+		others = append(others, p)
+	}
+	require.Empty(t, rt.DropInvalidPeers())
+
+	b, err := rt.TryAddPeer(local, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+	require.Equal(t, []peer.ID{local}, rt.DropInvalidPeers())
+	require.ElementsMatch(t, others, rt.ListPeers())
+	require.NoError(t, rt.CheckInvariants())
+}
+
+func TestSplitToCpl(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(2, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	var peers []peer.ID
+	for _, cpl := range []uint{0, 3, 5} {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		peers = append(peers, p)
+	}
+	require.False(t, rt.HasBucketForCpl(5))
+
+	rt.SplitToCpl(6)
+	require.True(t, rt.HasBucketForCpl(6))
+	require.Equal(t, 8, rt.MaxDepthReached())
+	require.Len(t, rt.SplitHistory(), 7)
+	require.NoError(t, rt.CheckInvariants())
+	rt.SplitToCpl(2)
+	require.Len(t, rt.SplitHistory(), 7)
+
+	// the deepened table still takes peers in their bucket and finds the nearest ones.
+	for _, cpl := range []uint{1, 3, 6, 9} {
+		p, err := rt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		b, err := rt.TryAddPeer(p, true, false)
+		require.NoError(t, err)
+		require.True(t, b)
+		peers = append(peers, p)
+	}
+	require.NoError(t, rt.CheckInvariants())
+	require.Equal(t, 2, rt.NPeersForCpl(3))
+	for i := 0; i < 10; i++ {
+		id := ConvertPeerID(test.RandPeerIDFatal(t))
+		require.Equal(t, SortClosestPeers(peers, id)[:4], rt.NearestPeers(id, 4))
+	}
+
+	// a Cpl beyond the local ID unfolds the table fully.
+	rt.SplitToCpl(1000)
+	rt.tabLock.RLock()
+	require.Len(t, rt.buckets, rt.maxBuckets())
+	rt.tabLock.RUnlock()
+	require.NoError(t, rt.CheckInvariants())
+}
@@ -1,7 +1,10 @@
 package kbucket
 
 import (
+	"bytes"
 	"errors"
+	"math/big"
+
 	"github.com/minio/sha256-simd"
 
 	ks "github.com/libp2p/go-libp2p-kbucket/keyspace"
@@ -30,6 +33,32 @@ func xor(a, b ID) ID {
 	return ID(u.XOR(a, b))
 }
 
+// Distance returns the xor distance between two IDs, interpreted as an unsigned integer.
+func Distance(a, b ID) *big.Int {
+	return new(big.Int).SetBytes(u.XOR(a, b))
+}
+
+// hasBitPrefix returns whether the first 'bits' bits of id are the same as the first 'bits' bits of prefix.
+// It is false if either of them is shorter than that.
+func hasBitPrefix(id ID, prefix []byte, bits int) bool {
+	if bits <= 0 {
+		return true
+	}
+	n := (bits + 7) / 8
+	if len(id) < n || len(prefix) < n {
+		return false
+	}
+	full := bits / 8
+	if !bytes.Equal(id[:full], prefix[:full]) {
+		return false
+	}
+	if rem := bits % 8; rem != 0 {
+		mask := byte(0xff) << (8 - rem)
+		return id[full]&mask == prefix[full]&mask
+	}
+	return true
+}
+
 func CommonPrefixLen(a, b ID) int {
 	return ks.ZeroPrefixLen(u.XOR(a, b))
 }
@@ -31,3 +31,25 @@ func TestCloser(t *testing.T) {
 	}
 	require.False(t, Closer(Pa, Pb, X))
 }
+
+func TestDistance(t *testing.T) {
+	a := ID{0x0f, 0x00}
+	b := ID{0x0e, 0x01}
+
+	require.Equal(t, int64(0x0101), Distance(a, b).Int64())
+	require.Equal(t, Distance(a, b), Distance(b, a))
+	require.Zero(t, Distance(a, a).Sign())
+}
+
+func TestHasBitPrefix(t *testing.T) {
+	id := ID{0xab, 0xcd}
+
+	require.True(t, hasBitPrefix(id, nil, 0))
+	require.True(t, hasBitPrefix(id, []byte{0xab}, 8))
+	require.True(t, hasBitPrefix(id, []byte{0xab, 0xc0}, 12))
+	require.True(t, hasBitPrefix(id, []byte{0xa0}, 3))
+	require.False(t, hasBitPrefix(id, []byte{0xab, 0xd0}, 12))
+	require.False(t, hasBitPrefix(id, []byte{0x2b}, 1))
+	require.False(t, hasBitPrefix(id, []byte{0xab}, 9))
+	require.False(t, hasBitPrefix(id, []byte{0xab, 0xcd, 0x00}, 17))
+}
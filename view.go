@@ -0,0 +1,40 @@
+package kbucket
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TableView is a read-only view of a RoutingTable.
+// It shares the underlying table and its locks, so reads through the view are
+// consistent with the table, but it does not expose any method that mutates it.
+type TableView struct {
+	rt *RoutingTable
+}
+
+// View returns a read-only view of the Routing Table.
+func (rt *RoutingTable) View() TableView {
+	return TableView{rt: rt}
+}
+
+// Size returns the total number of peers in the routing table
+func (v TableView) Size() int {
+	return v.rt.Size()
+}
+
+// NearestPeers returns a list of the 'count' closest peers to the given ID
+func (v TableView) NearestPeers(id ID, count int) []peer.ID {
+	return v.rt.NearestPeers(id, count)
+}
+
+// ListPeers returns a list of all peers from all buckets in the table.
+func (v TableView) ListPeers() []peer.ID {
+	return v.rt.ListPeers()
+}
+
+// Contains returns true if the given peer is in the routing table.
+func (v TableView) Contains(p peer.ID) bool {
+	v.rt.rlockTable()
+	defer v.rt.tabLock.RUnlock()
+
+	return v.rt.buckets[v.rt.bucketIdForPeer(p)].getPeer(p) != nil
+}
@@ -0,0 +1,43 @@
+package kbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableView(t *testing.T) {
+	t.Parallel()
+
+	local := test.RandPeerIDFatal(t)
+	m := pstore.NewMetrics()
+	rt, err := NewRoutingTable(10, ConvertPeerID(local), time.Hour, m, NoOpThreshold, nil)
+	require.NoError(t, err)
+
+	v := rt.View()
+	require.Zero(t, v.Size())
+	require.Empty(t, v.ListPeers())
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	b, err := rt.TryAddPeer(p1, true, false)
+	require.NoError(t, err)
+	require.True(t, b)
+
+	// the view reflects changes made to the table.
+	require.Equal(t, 1, v.Size())
+	require.True(t, v.Contains(p1))
+	require.False(t, v.Contains(p2))
+	require.Equal(t, []peer.ID{p1}, v.ListPeers())
+	require.Equal(t, rt.NearestPeers(ConvertPeerID(p2), 5), v.NearestPeers(ConvertPeerID(p2), 5))
+
+	rt.RemovePeer(p1)
+	require.False(t, v.Contains(p1))
+	require.Zero(t, v.Size())
+}